@@ -0,0 +1,34 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Writes a snapshot of the MetaDataNode's database to w. Returns its size.
+func (self *Client) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	var n int64
+	err := self.withLeader(ctx, func(conn net.Conn) error {
+		leader := NewRPCClient(conn)
+		defer leader.Close()
+
+		var size int64
+		if err := leader.Call("Backup", nil, &size); err != nil {
+			return err
+		}
+		var err error
+		n, err = io.Copy(w, io.LimitReader(leader.Reader(), size))
+		if err == nil && n < size {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+	if err != nil {
+		return n, errors.New("Backup error: " + err.Error())
+	}
+	return n, nil
+}
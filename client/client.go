@@ -0,0 +1,145 @@
+// Library for reading and writing blobs on the cluster.
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+type Client struct {
+	LeaderAddress string
+	// The other MetaDataNodes in a Raft cluster, asked in turn who leads
+	// when the ones before them can't be reached
+	MetaDataNodes []string
+	Debug         bool
+	Checksum      string // Algorithm for new blocks, see common.NewChecksumHash
+	Parallel      int    // How many blocks to upload at once
+	BlockSize     int64  // For new blobs, 0 for the cluster default
+	// For new blobs, 0 for the cluster default
+	ReplicationFactor int
+	// Called with the total bytes of a blob that have been uploaded, each
+	// time a block is done
+	Progress func(written int64)
+
+	mutex      sync.Mutex
+	redirected string    // The leader, if LeaderAddress isn't it
+	asked      bool      // Whether the MetaDataNode said if it's federated
+	federation *HashRing // Nil without a federation
+	members    map[string]*Client
+}
+
+// How many times to follow a redirect or wait for an election
+const maxRedirects = 20
+
+func New(leaderAddress string, debug bool, metaDataNodes ...string) *Client {
+	return &Client{LeaderAddress: leaderAddress, MetaDataNodes: metaDataNodes, Debug: debug, Checksum: DefaultChecksum, Parallel: 4}
+}
+
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+func (self *Client) rpcClient(conn net.Conn) *rpc.Client {
+	codec := jsonrpc.NewClientCodec(conn)
+	if self.Debug {
+		codec = LoggingClientCodec(
+			conn.RemoteAddr().String(),
+			codec)
+	}
+	return rpc.NewClientWithCodec(codec)
+}
+
+func (self *Client) leader() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.redirected != "" {
+		return self.redirected
+	}
+	return self.LeaderAddress
+}
+
+func (self *Client) redirect(addr string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.redirected = addr
+}
+
+// The first MetaDataNode the client was given that hasn't failed to dial
+func (self *Client) untried(failed map[string]bool) (string, bool) {
+	for _, addr := range append([]string{self.LeaderAddress}, self.MetaDataNodes...) {
+		if !failed[addr] {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// Runs f on a connection to the leader, following MetaDataNodes that send
+// the client elsewhere. Where it ends up is remembered for later calls.
+func (self *Client) withLeader(ctx context.Context, f func(conn net.Conn) error) error {
+	var err error
+	failed := map[string]bool{}
+	for attempt := 0; attempt < maxRedirects; attempt++ {
+		addr := self.leader()
+		conn, dialErr := dial(ctx, addr)
+		if dialErr != nil {
+			err = errors.New("Dial error: " + dialErr.Error())
+			failed[addr] = true
+			// The leader is gone, ask one of the others who leads now
+			next, ok := self.untried(failed)
+			if !ok {
+				return err
+			}
+			self.redirect(next)
+			continue
+		}
+		err = f(conn)
+		redirect, ok := LeaderRedirect(err)
+		if !ok {
+			return err
+		}
+		if redirect == "" {
+			// Between leaders, ask the same one again
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(250 * time.Millisecond):
+			}
+			continue
+		}
+		self.redirect(redirect)
+	}
+	return err
+}
+
+// Errors from the MetaDataNode are rpc.ServerErrors
+func (self *Client) callLeader(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return self.withLeader(ctx, func(conn net.Conn) error {
+		leader := self.rpcClient(conn)
+		defer leader.Close()
+		return leader.Call(method, args, reply)
+	})
+}
+
+// One-off call to the MetaDataNode in charge of key
+func (self *Client) call(ctx context.Context, key string, method string, args interface{}, reply interface{}) error {
+	if err := self.callOwner(ctx, key, method, args, reply); err != nil {
+		return errors.New(method + " error: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// In a federation, each MetaDataNode is in charge of the blobs and top-level
+// directories that hash to its part of the ring. The MetaDataNode the client
+// is given is asked for the others once, then every call goes straight to
+// whichever one is in charge of what it's about.
+
+// The federation's ring, or nil if there isn't one
+func (self *Client) ring(ctx context.Context) (*HashRing, error) {
+	self.mutex.Lock()
+	if self.asked {
+		defer self.mutex.Unlock()
+		return self.federation, nil
+	}
+	self.mutex.Unlock()
+
+	var members []string
+	if err := self.callLeader(ctx, "Federation", nil, &members); err != nil {
+		return nil, err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.asked = true
+	if len(members) > 0 {
+		self.federation = NewHashRing(members)
+		self.members = map[string]*Client{}
+	}
+	return self.federation, nil
+}
+
+// A client for one MetaDataNode in the federation. Must hold mutex.
+func (self *Client) member(addr string) *Client {
+	if addr == self.LeaderAddress {
+		return self
+	}
+	if self.members[addr] == nil {
+		self.members[addr] = &Client{LeaderAddress: addr, Debug: self.Debug, asked: true}
+	}
+	return self.members[addr]
+}
+
+// The client for the MetaDataNode in charge of key, which is this one
+// without a federation. Anything can go to any of them with an empty key.
+func (self *Client) owner(ctx context.Context, key string) (*Client, error) {
+	ring, err := self.ring(ctx)
+	if err != nil || ring == nil || key == "" {
+		return self, err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.member(ring.Owner(key)), nil
+}
+
+// Like callLeader, to the MetaDataNode in charge of key
+func (self *Client) callOwner(ctx context.Context, key string, method string, args interface{}, reply interface{}) error {
+	owner, err := self.owner(ctx, key)
+	if err != nil {
+		return errors.New("Federation error: " + err.Error())
+	}
+	return owner.callLeader(ctx, method, args, reply)
+}
+
+// Each MetaDataNode's entries under a directory that isn't any one of
+// theirs, together
+func (self *Client) listAll(ctx context.Context, ring *HashRing, path string) ([]FileInfo, error) {
+	var all []FileInfo
+	for _, addr := range ring.Members() {
+		self.mutex.Lock()
+		member := self.member(addr)
+		self.mutex.Unlock()
+		var entries []FileInfo
+		if err := member.callLeader(ctx, "List", path, &entries); err != nil {
+			return nil, errors.New("List error: " + err.Error())
+		}
+		all = append(all, entries...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Path < all[j].Path })
+	return all, nil
+}
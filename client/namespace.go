@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"errors"
+
+	. "golang-distributed-filesystem/common"
+)
+
+func (self *Client) Mkdir(ctx context.Context, path string) error {
+	return self.call(ctx, PathKey(path), "Mkdir", path, nil)
+}
+
+// In a federation, "/" is listed from every MetaDataNode
+func (self *Client) List(ctx context.Context, path string) ([]FileInfo, error) {
+	if PathKey(path) == "" {
+		ring, err := self.ring(ctx)
+		if err != nil {
+			return nil, errors.New("List error: " + err.Error())
+		}
+		if ring != nil {
+			return self.listAll(ctx, ring, path)
+		}
+	}
+	var entries []FileInfo
+	err := self.call(ctx, PathKey(path), "List", path, &entries)
+	return entries, err
+}
+
+func (self *Client) Stat(ctx context.Context, path string) (FileInfo, error) {
+	var info FileInfo
+	err := self.call(ctx, PathKey(path), "Stat", path, &info)
+	return info, err
+}
+
+// A blob's metadata and blocks, open or committed
+func (self *Client) StatBlob(ctx context.Context, blobID string) (BlobInfo, error) {
+	var info BlobInfo
+	err := self.call(ctx, BlobKey(blobID), "StatBlob", blobID, &info)
+	return info, err
+}
+
+func (self *Client) Rename(ctx context.Context, from string, to string) error {
+	return self.call(ctx, PathKey(from), "Rename", &RenameMsg{from, to}, nil)
+}
+
+func (self *Client) Delete(ctx context.Context, path string, recursive bool) error {
+	return self.call(ctx, PathKey(path), "Delete", &DeleteMsg{path, recursive}, nil)
+}
+
+// Reads fail right away, the blocks are cleaned up in the background
+func (self *Client) DeleteBlob(ctx context.Context, blobID string) error {
+	return self.call(ctx, BlobKey(blobID), "DeleteBlob", blobID, nil)
+}
+
+// The MetaDataNode adds or drops replicas of existing blocks to match
+func (self *Client) SetReplication(ctx context.Context, blobID string, n int) error {
+	return self.call(ctx, BlobKey(blobID), "SetReplication", &SetReplicationMsg{blobID, n}, nil)
+}
+
+func (self *Client) OpenPath(ctx context.Context, path string) (*Reader, error) {
+	info, err := self.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return nil, errors.New("Is a directory: '" + info.Path + "'")
+	}
+	return self.Open(ctx, info.BlobID)
+}
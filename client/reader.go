@@ -0,0 +1,290 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// How many times to go through a block's replicas before giving up
+const maxAttempts = 50
+
+// How much to fetch past a read, so sequential reads don't cost a round trip
+const readAhead = 4 * 1024 * 1024
+
+// Reads a committed blob. Data is fetched with ranged reads, a window at a
+// time. Blobs committed before block sizes were recorded fall back to
+// fetching (and verifying) whole blocks.
+type Reader struct {
+	client *Client
+	ctx    context.Context
+	blobID string
+	blocks []BlockID
+	offset int64
+
+	mutex       sync.Mutex
+	sizes       []int64 // -1 until the block has been fetched
+	cachedIndex int
+	cachedStart int64 // Offset within the block
+	cached      []byte
+}
+
+func (self *Client) Open(ctx context.Context, blobID string) (*Reader, error) {
+	var blocks []BlockInfo
+	if err := self.call(ctx, BlobKey(blobID), "GetBlobBlocks", blobID, &blocks); err != nil {
+		return nil, err
+	}
+
+	r := &Reader{client: self, ctx: ctx, blobID: blobID, cachedIndex: -1}
+	for _, b := range blocks {
+		r.blocks = append(r.blocks, b.BlockID)
+		r.sizes = append(r.sizes, b.Size)
+	}
+	return r, nil
+}
+
+func (self *Reader) Read(p []byte) (int, error) {
+	n, err := self.ReadAt(p, self.offset)
+	self.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (self *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	read := 0
+	var blockStart int64
+	for i := 0; i < len(self.blocks) && read < len(p); i++ {
+		if self.sizes[i] < 0 {
+			if err := self.fetchWhole(i); err != nil {
+				return read, err
+			}
+		}
+		blockEnd := blockStart + self.sizes[i]
+		for pos := off + int64(read); pos < blockEnd && read < len(p); pos = off + int64(read) {
+			data, err := self.fetch(i, pos-blockStart, int64(len(p)-read))
+			if err != nil {
+				return read, err
+			}
+			read += copy(p[read:], data)
+		}
+		blockStart = blockEnd
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (self *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.offset
+	case io.SeekEnd:
+		size, err := self.Size()
+		if err != nil {
+			return self.offset, err
+		}
+		offset += size
+	default:
+		return self.offset, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return self.offset, errors.New("Negative offset")
+	}
+	self.offset = offset
+	return offset, nil
+}
+
+func (self *Reader) Size() (int64, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var size int64
+	for i := range self.blocks {
+		if self.sizes[i] < 0 {
+			if err := self.fetchWhole(i); err != nil {
+				return -1, err
+			}
+		}
+		size += self.sizes[i]
+	}
+	return size, nil
+}
+
+func (self *Reader) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.cached = nil
+	self.cachedIndex = -1
+	return nil
+}
+
+// Returns data starting at offset in block i, fetching a window of at least
+// length bytes if it isn't cached. Must hold mutex.
+func (self *Reader) fetch(i int, offset int64, length int64) ([]byte, error) {
+	if i == self.cachedIndex && offset >= self.cachedStart &&
+		offset < self.cachedStart+int64(len(self.cached)) {
+		return self.cached[offset-self.cachedStart:], nil
+	}
+	if length < readAhead {
+		length = readAhead
+	}
+	data, err := self.client.getRange(self.ctx, BlockRange{self.blocks[i], offset, length})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	self.cachedIndex = i
+	self.cachedStart = offset
+	self.cached = data
+	return data, nil
+}
+
+// For blocks of unknown size. Must hold mutex.
+func (self *Reader) fetchWhole(i int) error {
+	data, err := self.client.getBlock(self.ctx, self.blocks[i])
+	if err != nil {
+		return err
+	}
+	self.sizes[i] = int64(len(data))
+	self.cachedIndex = i
+	self.cachedStart = 0
+	self.cached = data
+	return nil
+}
+
+// Tries every replica of a block, waiting for replicas that are busy
+func (self *Client) fromReplicas(ctx context.Context, blockID BlockID, f func(addr string) ([]byte, error)) ([]byte, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var nodes []string
+		if err := self.call(ctx, BlobKey(string(blockID)), "GetBlock", blockID, &nodes); err != nil {
+			return nil, err
+		}
+		if len(nodes) == 0 {
+			return nil, errors.New("No DataNodes have block '" + string(blockID) + "'")
+		}
+
+		locked := false
+		for _, i := range rand.Perm(len(nodes)) {
+			data, err := f(nodes[i])
+			if err == nil {
+				return data, nil
+			}
+			if err.Error() == "Couldn't get read lock" {
+				locked = true
+			}
+			log.Println("Reading block '"+string(blockID)+"' from", nodes[i], "->", err)
+		}
+		if !locked {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil, errors.New("Couldn't read block '" + string(blockID) + "' from any DataNode")
+}
+
+func (self *Client) getRange(ctx context.Context, blockRange BlockRange) ([]byte, error) {
+	return self.fromReplicas(ctx, blockRange.BlockID, func(addr string) ([]byte, error) {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		dataNode := NewRPCClient(conn)
+		defer dataNode.Close()
+
+		var resp BlockRangeResponse
+		if err := dataNode.Call("GetRange", &blockRange, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Offset > blockRange.Offset || resp.Offset+resp.Length < blockRange.Offset {
+			return nil, errors.New("DataNode sent the wrong range")
+		}
+		data := make([]byte, resp.Length)
+		if _, err := io.ReadFull(dataNode.Reader(), data); err != nil {
+			return nil, err
+		}
+		if err := verifyChunks(data, resp.ChunkSize, resp.Chunks); err != nil {
+			return nil, err
+		}
+		data = data[blockRange.Offset-resp.Offset:]
+		if int64(len(data)) > blockRange.Length {
+			data = data[:blockRange.Length]
+		}
+		return data, nil
+	})
+}
+
+func verifyChunks(data []byte, chunkSize int64, chunks []string) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if chunkSize <= 0 {
+		return errors.New("No chunk checksums")
+	}
+	if int64(len(chunks)) != (int64(len(data))+chunkSize-1)/chunkSize {
+		return errors.New("Wrong number of chunk checksums")
+	}
+	for i, sum := range chunks {
+		chunk := data[int64(i)*chunkSize:]
+		if int64(len(chunk)) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		if err := VerifyChecksum(sum, chunk); err != nil {
+			return fmt.Errorf("Chunk %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Fetches a whole block from any replica that has a good copy
+func (self *Client) getBlock(ctx context.Context, blockID BlockID) ([]byte, error) {
+	return self.fromReplicas(ctx, blockID, func(addr string) ([]byte, error) {
+		return self.getBlockFrom(ctx, addr, blockID)
+	})
+}
+
+func (self *Client) getBlockFrom(ctx context.Context, addr string, blockID BlockID) ([]byte, error) {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	dataNode := NewRPCClient(conn)
+	defer dataNode.Close()
+
+	var sums BlockChecksums
+	if err := dataNode.Call("Get", blockID, &sums); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, dataNode.Reader()); err != nil {
+		return nil, err
+	}
+	if err := VerifyChecksum(sums.Checksum, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
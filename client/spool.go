@@ -0,0 +1,66 @@
+package client
+
+import (
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Holds a block until it's full. Blocks are too big to keep in memory, so
+// they go to a temp file that's reused for every block of a blob.
+type spool struct {
+	file      *os.File
+	size      int64
+	algorithm string
+	hash      hash.Hash
+}
+
+func newSpool(algorithm string) (*spool, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile("", "block-")
+	if err != nil {
+		return nil, err
+	}
+	// Still usable, and nothing's left behind if we crash
+	os.Remove(file.Name())
+	return &spool{file, 0, algorithm, h}, nil
+}
+
+func (self *spool) Write(p []byte) (int, error) {
+	n, err := self.file.Write(p)
+	self.hash.Write(p[:n])
+	self.size += int64(n)
+	return n, err
+}
+
+func (self *spool) Checksum() string {
+	return FormatChecksum(self.algorithm, self.hash)
+}
+
+// Everything written since the last reset
+func (self *spool) Reader() (io.Reader, error) {
+	if _, err := self.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(self.file, self.size), nil
+}
+
+func (self *spool) Reset() error {
+	self.size = 0
+	self.hash.Reset()
+	if err := self.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := self.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (self *spool) Close() error {
+	return self.file.Close()
+}
@@ -0,0 +1,21 @@
+package client
+
+import (
+	"context"
+	"errors"
+)
+
+// Promotes the standby MetaDataNode at LeaderAddress to take over from its
+// primary. Unlike other calls, it isn't redirected to the primary.
+func (self *Client) Promote(ctx context.Context) error {
+	conn, err := dial(ctx, self.LeaderAddress)
+	if err != nil {
+		return errors.New("Dial error: " + err.Error())
+	}
+	standby := self.rpcClient(conn)
+	defer standby.Close()
+	if err := standby.Call("Promote", nil, nil); err != nil {
+		return errors.New("Promote error: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,427 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// How many times to try a call to the MetaDataNode when the network fails
+const leaderAttempts = 10
+
+// Spools a block at a time and sends it down a DataNode pipeline once full,
+// so the length of the blob doesn't need to be known up front. Up to
+// Client.Parallel blocks are sent at once, each to its own pipeline. Nothing
+// is visible to readers until Close commits the blob. The lease is renewed in
+// the background until then, and every call to the MetaDataNode is on its own
+// connection so a dropped one can be retried.
+type Writer struct {
+	client *Client
+	ctx    context.Context
+	lease  Lease
+	stop   chan bool
+
+	block  *ForwardBlock
+	spool  *spool
+	free   chan *spool // Spools that have been sent
+	slots  chan bool   // One for every block being sent
+	sends  sync.WaitGroup
+	closed bool
+	acking sync.Mutex // Held while acknowledging, so blocks go in order
+
+	mutex    sync.Mutex
+	blocks   []BlockInfo // In blob order
+	replicas [][]string  // nil until the block is sent
+	acked    int         // The blocks before this are acknowledged
+	written  int64       // Bytes in acknowledged blocks
+	err      error
+}
+
+func (self *Client) newWriter(ctx context.Context) *Writer {
+	parallel := self.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	return &Writer{
+		client: self,
+		ctx:    ctx,
+		stop:   make(chan bool),
+		free:   make(chan *spool, parallel+1),
+		slots:  make(chan bool, parallel)}
+}
+
+func (self *Client) Create(ctx context.Context) (*Writer, error) {
+	return self.CreateAt(ctx, "")
+}
+
+// The blob shows up at path once it's committed
+func (self *Client) CreateAt(ctx context.Context, path string) (*Writer, error) {
+	w := self.newWriter(ctx)
+	if err := w.leaderCall(PathKey(path), "CreateBlob", &CreateBlobMsg{path, self.BlockSize, self.ReplicationFactor}, &w.lease); err != nil {
+		return nil, err
+	}
+	go w.renewLease(w.lease.Expires)
+	return w, nil
+}
+
+// Picks up an upload that was interrupted, with the resume token of the
+// Writer that started it. Returns how much of the blob was already written,
+// the rest should be written from there.
+func (self *Client) Resume(ctx context.Context, blobID string, resumeToken string) (*Writer, int64, error) {
+	w := self.newWriter(ctx)
+	var resume ResumeResponse
+	if err := w.leaderCall(BlobKey(blobID), "ResumeBlob", &ResumeMsg{blobID, resumeToken}, &resume); err != nil {
+		return nil, 0, err
+	}
+	w.lease = resume.Lease
+	w.blocks = resume.Blocks
+	w.replicas = make([][]string, len(w.blocks))
+	w.acked = len(w.blocks)
+	for i, b := range w.blocks {
+		w.replicas[i] = []string{}
+		w.written += b.Size
+	}
+	go w.renewLease(w.lease.Expires)
+	return w, w.written, nil
+}
+
+// Uploads everything up to EOF from a stream of any length
+func (self *Client) Upload(ctx context.Context, r io.Reader, path string) (string, error) {
+	w, err := self.CreateAt(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.abandon()
+		return "", err
+	}
+	return w.BlobID(), w.Close()
+}
+
+func (self *Writer) BlobID() string {
+	return self.lease.BlobID
+}
+
+// What Resume needs, besides the blob ID, to pick the upload up if this
+// Writer goes away
+func (self *Writer) ResumeToken() string {
+	return self.lease.ResumeToken
+}
+
+func (self *Writer) Write(p []byte) (int, error) {
+	if self.closed {
+		return 0, errors.New("Writer is closed")
+	}
+	written := 0
+	for len(p) > 0 {
+		if err := self.error(); err != nil {
+			return written, err
+		}
+		if self.block == nil {
+			self.setError(self.appendBlock())
+			continue
+		}
+		n := int(self.block.Size - self.spool.size)
+		if n > len(p) {
+			n = len(p)
+		}
+		n, err := self.spool.Write(p[:n])
+		self.setError(err)
+		p = p[n:]
+		written += n
+		if self.spool.size == self.block.Size {
+			self.flushBlock()
+		}
+	}
+	return written, self.error()
+}
+
+// Sends any partial block, waits for every block to be sent and commits the
+// blob
+func (self *Writer) Close() error {
+	if self.closed {
+		return self.error()
+	}
+	defer self.abandon()
+
+	if self.block != nil && self.spool.size > 0 {
+		self.flushBlock()
+	}
+	self.sends.Wait()
+	if err := self.error(); err != nil {
+		return err
+	}
+	if err := self.ctx.Err(); err != nil {
+		self.setError(err)
+		return err
+	}
+	self.setError(self.leaderCall(BlobKey(self.lease.BlobID), "Commit", &CommitMsg{self.lease.BlobID, self.lease.Token, self.blocks}, nil))
+	return self.error()
+}
+
+// The first thing that went wrong, from writing or from any of the sends
+func (self *Writer) error() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.err
+}
+
+func (self *Writer) setError(err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.err == nil {
+		self.err = err
+	}
+}
+
+// Stops renewing the lease, so it expires if it wasn't committed
+func (self *Writer) abandon() {
+	if self.closed {
+		return
+	}
+	self.closed = true
+	self.sends.Wait()
+	close(self.stop)
+	if self.spool != nil {
+		self.spool.Close()
+	}
+	for len(self.free) > 0 {
+		(<-self.free).Close()
+	}
+}
+
+// Renews at a third of the time left, so a couple of failures can be retried
+func (self *Writer) renewLease(expires time.Time) {
+	msg := LeaseMsg{self.lease.BlobID, self.lease.Token}
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-self.ctx.Done():
+			return
+		case <-time.After(expires.Sub(time.Now()) / 3):
+		}
+		if err := self.leaderCall(BlobKey(self.lease.BlobID), "RenewLease", &msg, &expires); err != nil {
+			log.Println(err)
+			if time.Now().After(expires) {
+				return
+			}
+		}
+	}
+}
+
+// Calls the MetaDataNode in charge of key on a new connection, retrying if
+// the network fails. Errors from the MetaDataNode itself aren't retried.
+func (self *Writer) leaderCall(key string, method string, args interface{}, reply interface{}) error {
+	var err error
+	for attempt := 0; attempt < leaderAttempts; attempt++ {
+		if attempt > 0 {
+			log.Println(method, "error:", err, "(retrying)")
+			select {
+			case <-self.ctx.Done():
+				return self.ctx.Err()
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			}
+		}
+		err = self.client.callOwner(self.ctx, key, method, args, reply)
+		if _, ok := err.(rpc.ServerError); err == nil || ok {
+			break
+		}
+	}
+	if err != nil {
+		return errors.New(method + " error: " + err.Error())
+	}
+	return nil
+}
+
+func (self *Writer) appendBlock() error {
+	if err := self.ctx.Err(); err != nil {
+		return err
+	}
+	var nodesMsg ForwardBlock
+	if err := self.leaderCall(BlobKey(self.lease.BlobID), "Append", &LeaseMsg{self.lease.BlobID, self.lease.Token}, &nodesMsg); err != nil {
+		return err
+	}
+	if nodesMsg.Size <= 0 {
+		return errors.New("Invalid block size from MetaDataNode")
+	}
+	if self.spool == nil {
+		select {
+		case self.spool = <-self.free:
+		default:
+			spool, err := newSpool(self.client.Checksum)
+			if err != nil {
+				return err
+			}
+			self.spool = spool
+		}
+	}
+	self.block = &nodesMsg
+	return nil
+}
+
+// Sends the block in the background once there's a free slot
+func (self *Writer) flushBlock() {
+	block, spool := self.block, self.spool
+	self.block, self.spool = nil, nil
+
+	self.slots <- true
+	self.mutex.Lock()
+	i := len(self.blocks)
+	self.blocks = append(self.blocks, BlockInfo{block.BlockID, spool.size, spool.Checksum()})
+	self.replicas = append(self.replicas, nil)
+	self.mutex.Unlock()
+
+	self.sends.Add(1)
+	go func() {
+		defer self.sends.Done()
+		defer func() { <-self.slots }()
+
+		replicas, err := self.sendBlock(block, spool)
+		if err == nil {
+			err = spool.Reset()
+		}
+		if err != nil {
+			spool.Close()
+			self.setError(err)
+			return
+		}
+		self.free <- spool
+		self.setError(self.sentBlock(i, replicas))
+	}()
+}
+
+// Acknowledges blocks in order, so that resuming never skips one that's
+// still being sent. The calls are made without holding mutex, so writing
+// carries on while they're retried.
+func (self *Writer) sentBlock(i int, replicas []string) error {
+	self.mutex.Lock()
+	self.replicas[i] = replicas
+	self.mutex.Unlock()
+
+	self.acking.Lock()
+	defer self.acking.Unlock()
+	for {
+		self.mutex.Lock()
+		if self.acked == len(self.blocks) || self.replicas[self.acked] == nil {
+			self.mutex.Unlock()
+			return nil
+		}
+		block := self.blocks[self.acked]
+		msg := AckBlockMsg{self.lease.BlobID, self.lease.Token, block, self.replicas[self.acked]}
+		self.mutex.Unlock()
+
+		if err := self.leaderCall(BlobKey(self.lease.BlobID), "AckBlock", &msg, nil); err != nil {
+			return err
+		}
+		self.mutex.Lock()
+		self.acked++
+		self.written += block.Size
+		written := self.written
+		self.mutex.Unlock()
+		if self.client.Progress != nil {
+			self.client.Progress(written)
+		}
+	}
+}
+
+// Asks the MetaDataNode for other DataNodes if none of the pipeline can be
+// reached, or if some of it didn't get the block. Only the missing replicas
+// are sent again, so no DataNode is left with a copy the MetaDataNode doesn't
+// count. The blob can't be committed until a whole pipeline has it. Returns
+// the DataNodes that have the block.
+func (self *Writer) sendBlock(block *ForwardBlock, spool *spool) ([]string, error) {
+	var excluded, kept []string
+	for attempt := 0; ; attempt++ {
+		if err := self.ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := spool.Reader()
+		if err != nil {
+			return nil, err
+		}
+		replicas, err := self.client.sendBlock(self.ctx, block.BlockID, block.Nodes, data, spool.size, spool.Checksum())
+		if err == nil && len(replicas) < len(block.Nodes) {
+			err = &unreachableError{missing(block.Nodes, replicas)}
+		}
+		kept = append(kept, replicas...)
+		unreachable, ok := err.(*unreachableError)
+		if err == nil || !ok || attempt == leaderAttempts {
+			return kept, err
+		}
+		log.Println(err, "(asking for others)")
+		excluded = append(excluded, unreachable.nodes...)
+		msg := ReplaceTargetsMsg{self.lease.BlobID, self.lease.Token, block.BlockID, excluded, kept}
+		block = new(ForwardBlock)
+		if err := self.leaderCall(BlobKey(self.lease.BlobID), "ReplaceTargets", &msg, block); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// DataNodes in a pipeline that couldn't be dialed or didn't get the block
+type unreachableError struct {
+	nodes []string
+}
+
+func (self *unreachableError) Error() string {
+	return "Couldn't get the block to DataNodes: " + strings.Join(self.nodes, " ")
+}
+
+func missing(nodes []string, replicas []string) []string {
+	var missing []string
+Nodes:
+	for _, n := range nodes {
+		for _, r := range replicas {
+			if n == r {
+				continue Nodes
+			}
+		}
+		missing = append(missing, n)
+	}
+	return missing
+}
+
+// Sends to the first DataNode that answers, which pipelines to the rest.
+// Returns the DataNodes that confirmed they have the block.
+func (self *Client) sendBlock(ctx context.Context, blockID BlockID, nodes []string, data io.Reader, size int64, checksum string) ([]string, error) {
+	var conn net.Conn
+	var first string
+	var forwardTo []string
+	for i, addr := range nodes {
+		var err error
+		conn, err = dial(ctx, addr)
+		if err == nil {
+			first = addr
+			forwardTo = append(append([]string{}, nodes[:i]...), nodes[i+1:]...)
+			break
+		}
+		log.Println("Dial error:", err)
+		conn = nil
+	}
+	if conn == nil {
+		return nil, &unreachableError{nodes}
+	}
+	dataNode := self.rpcClient(conn)
+	defer dataNode.Close()
+
+	if err := dataNode.Call("Forward", &ForwardBlock{blockID, forwardTo, size, ChecksumAlgorithm(checksum)}, nil); err != nil {
+		return nil, errors.New("Forward error: " + err.Error())
+	}
+	if _, err := io.Copy(conn, data); err != nil {
+		return nil, err
+	}
+	var replicas []string
+	if err := dataNode.Call("Confirm", checksum, &replicas); err != nil {
+		return nil, errors.New("Confirm error: " + err.Error())
+	}
+	return append([]string{first}, replicas...), nil
+}
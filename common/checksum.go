@@ -0,0 +1,86 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// Checksums are written as "<algorithm>:<hex digest>". A bare decimal number
+// is a CRC32-IEEE checksum from before the algorithm was recorded.
+const (
+	CRC32  = "crc32"
+	CRC32C = "crc32c"
+	SHA256 = "sha256"
+
+	DefaultChecksum = CRC32C
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case CRC32:
+		return crc32.NewIEEE(), nil
+	case CRC32C:
+		return crc32.New(castagnoli), nil
+	case SHA256:
+		return sha256.New(), nil
+	default:
+		return nil, errors.New("Unknown checksum algorithm '" + algorithm + "'")
+	}
+}
+
+func FormatChecksum(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+func Checksum(algorithm string, data []byte) (string, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return FormatChecksum(algorithm, h), nil
+}
+
+func ChecksumAlgorithm(sum string) string {
+	if i := strings.Index(sum, ":"); i >= 0 {
+		return sum[:i]
+	}
+	return CRC32
+}
+
+// Rewrites old decimal checksums in the typed form so they can be compared
+func NormalizeChecksum(sum string) string {
+	if strings.Contains(sum, ":") {
+		return strings.ToLower(sum)
+	}
+	n, err := strconv.ParseUint(sum, 10, 32)
+	if err != nil {
+		return sum
+	}
+	// Same byte order as hash/crc32's Sum
+	b := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	return CRC32 + ":" + hex.EncodeToString(b)
+}
+
+func ChecksumsEqual(a, b string) bool {
+	return NormalizeChecksum(a) == NormalizeChecksum(b)
+}
+
+// Checks data against a checksum of any algorithm
+func VerifyChecksum(sum string, data []byte) error {
+	local, err := Checksum(ChecksumAlgorithm(sum), data)
+	if err != nil {
+		return err
+	}
+	if !ChecksumsEqual(sum, local) {
+		return errors.New("Checksum doesn't match")
+	}
+	return nil
+}
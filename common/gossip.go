@@ -0,0 +1,506 @@
+package common
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SWIM-style membership over UDP. Every probe interval each member pings
+// another one, and asks a few others to ping it too if it doesn't answer in
+// time. A member that still hasn't answered is suspected, and taken as dead
+// if nobody hears from it within the suspicion timeout. A member that hears
+// it's suspected raises its incarnation to say it's alive. Changes are
+// piggybacked on the pings and acks, and every so often a member swaps
+// everything it knows with another one, which is also how it joins.
+
+// Members asked to ping a member that didn't answer
+const indirectProbes = 3
+
+// Changes sent with each message
+const maxPiggyback = 8
+
+// Each change is sent this many times the log of the number of members
+const retransmitMult = 3
+
+// Probes between swapping everything with another member
+const syncEvery = 10
+
+// The whole membership has to fit in one packet to sync
+const maxGossipPacket = 65507
+
+type MemberState int
+
+const (
+	Alive MemberState = iota
+	Suspect
+	Dead
+)
+
+func (self MemberState) String() string {
+	switch self {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+// What a member says about itself
+type GossipMeta struct {
+	DataNode     string   // RPC address of a DataNode
+	SpaceUsed    int      // Blocks a DataNode has
+	MetaDataNode string   // Cluster address of a MetaDataNode
+	Waiting      []string // DataNodes a MetaDataNode wants to hear from
+}
+
+type Member struct {
+	Addr string // Gossip address, which it's known by
+	// Only raised by the member itself, to refute suspicion or change Meta.
+	// Starts at the time it started, so it's higher after a restart.
+	Incarnation uint64
+	State       MemberState
+	Meta        GossipMeta
+}
+
+type GossipConfig struct {
+	Conn net.PacketConn
+	// How the others reach this member. Defaults to Conn's address.
+	Addr  string
+	Seeds []string // Gossip addresses to join through
+	Meta  GossipMeta
+	// Defaults to 1 second
+	ProbeInterval time.Duration
+	// How long to wait for a ping before asking others. Defaults to a third
+	// of ProbeInterval.
+	ProbeTimeout time.Duration
+	// How long a member can be suspected before it's dead. Defaults to 5
+	// probe intervals.
+	SuspicionTimeout time.Duration
+	// Called whenever a member's state or Meta changes, without locks held
+	Notify func(Member)
+}
+
+type Gossip struct {
+	mutex      sync.Mutex
+	conf       GossipConfig
+	self       Member
+	members    map[string]*gossipMember
+	probeOrder []string
+	probeNext  int
+	seq        uint64
+	acks       map[uint64]chan bool
+	updates    []*gossipUpdate
+	stopped    bool
+}
+
+type gossipMember struct {
+	Member
+	suspectedAt time.Time
+}
+
+type gossipUpdate struct {
+	member Member
+	sent   int
+}
+
+type gossipMsg struct {
+	Type    string // ping, ack, ping-req, sync or sync-ack
+	Seq     uint64
+	Target  string // Who to ping, for ping-req
+	Updates []Member
+}
+
+func NewGossip(conf GossipConfig) *Gossip {
+	if conf.Addr == "" {
+		conf.Addr = conf.Conn.LocalAddr().String()
+	}
+	if conf.ProbeInterval == 0 {
+		conf.ProbeInterval = time.Second
+	}
+	if conf.ProbeTimeout == 0 {
+		conf.ProbeTimeout = conf.ProbeInterval / 3
+	}
+	if conf.SuspicionTimeout == 0 {
+		conf.SuspicionTimeout = 5 * conf.ProbeInterval
+	}
+	self := &Gossip{
+		conf:    conf,
+		self:    Member{conf.Addr, uint64(time.Now().UnixNano()), Alive, conf.Meta},
+		members: map[string]*gossipMember{},
+		acks:    map[uint64]chan bool{},
+	}
+	self.queue(self.self)
+	log.Println("Gossiping on", conf.Addr)
+	go self.receive()
+	go self.probeLoop()
+	return self
+}
+
+func (self *Gossip) Addr() string {
+	return self.self.Addr
+}
+
+// Everything known about the other members, dead ones included
+func (self *Gossip) Members() []Member {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var members []Member
+	for _, m := range self.members {
+		members = append(members, m.Member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Addr < members[j].Addr })
+	return members
+}
+
+// Tells the other members, if it's changed
+func (self *Gossip) SetMeta(meta GossipMeta) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if reflect.DeepEqual(meta, self.self.Meta) {
+		return
+	}
+	self.self.Meta = meta
+	self.self.Incarnation++
+	self.queue(self.self)
+}
+
+// Stops answering, as if the member had died
+func (self *Gossip) Stop() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.stopped {
+		self.stopped = true
+		self.conf.Conn.Close()
+	}
+}
+
+func (self *Gossip) isStopped() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.stopped
+}
+
+func (self *Gossip) receive() {
+	buf := make([]byte, maxGossipPacket)
+	for {
+		n, from, err := self.conf.Conn.ReadFrom(buf)
+		if err != nil {
+			if !self.isStopped() {
+				log.Println("Gossip:", err)
+				self.Stop()
+			}
+			return
+		}
+		var msg gossipMsg
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			log.Println("Gossip from", from, "->", err)
+			continue
+		}
+		self.handle(from, msg)
+	}
+}
+
+func (self *Gossip) handle(from net.Addr, msg gossipMsg) {
+	self.mutex.Lock()
+	var changed []Member
+	for _, u := range msg.Updates {
+		if m, ok := self.merge(u); ok {
+			changed = append(changed, m)
+		}
+	}
+	self.mutex.Unlock()
+	self.notify(changed)
+
+	switch msg.Type {
+	case "ping":
+		self.sendTo(from, gossipMsg{Type: "ack", Seq: msg.Seq})
+	case "ack":
+		self.acked(msg.Seq)
+	case "ping-req":
+		go self.pingFor(from, msg)
+	case "sync":
+		self.sendTo(from, self.everything("sync-ack"))
+	}
+}
+
+// Pings the target of a ping-req, and passes its ack on
+func (self *Gossip) pingFor(from net.Addr, req gossipMsg) {
+	seq, acked := self.expectAck()
+	defer self.forgetAck(seq)
+	self.send(req.Target, gossipMsg{Type: "ping", Seq: seq})
+	select {
+	case <-acked:
+		self.sendTo(from, gossipMsg{Type: "ack", Seq: req.Seq})
+	case <-time.After(self.conf.ProbeInterval):
+	}
+}
+
+func (self *Gossip) probeLoop() {
+	for i := 0; !self.isStopped(); i++ {
+		start := time.Now()
+		if i%syncEvery == 0 {
+			self.sync()
+		}
+		self.probe()
+		self.expireSuspects()
+		time.Sleep(self.conf.ProbeInterval - time.Since(start))
+	}
+}
+
+func (self *Gossip) probe() {
+	target, ok := self.nextTarget()
+	if !ok {
+		return
+	}
+	seq, acked := self.expectAck()
+	defer self.forgetAck(seq)
+	self.send(target, gossipMsg{Type: "ping", Seq: seq})
+	select {
+	case <-acked:
+		return
+	case <-time.After(self.conf.ProbeTimeout):
+	}
+	for _, other := range self.randomMembers(indirectProbes, target) {
+		self.send(other, gossipMsg{Type: "ping-req", Seq: seq, Target: target})
+	}
+	select {
+	case <-acked:
+		return
+	case <-time.After(self.conf.ProbeInterval - self.conf.ProbeTimeout):
+	}
+
+	self.mutex.Lock()
+	m := self.members[target]
+	var changed []Member
+	if m != nil && m.State == Alive {
+		suspect := m.Member
+		suspect.State = Suspect
+		if m, ok := self.merge(suspect); ok {
+			changed = append(changed, m)
+		}
+	}
+	self.mutex.Unlock()
+	self.notify(changed)
+}
+
+// Swaps everything with a random member, or the seeds if it doesn't know
+// any yet
+func (self *Gossip) sync() {
+	targets := self.randomMembers(1, "")
+	if len(targets) == 0 {
+		targets = self.conf.Seeds
+	}
+	msg := self.everything("sync")
+	for _, addr := range targets {
+		if addr != self.self.Addr {
+			self.send(addr, msg)
+		}
+	}
+}
+
+func (self *Gossip) expireSuspects() {
+	self.mutex.Lock()
+	var changed []Member
+	for _, m := range self.members {
+		if m.State == Suspect && time.Since(m.suspectedAt) > self.conf.SuspicionTimeout {
+			dead := m.Member
+			dead.State = Dead
+			if m, ok := self.merge(dead); ok {
+				changed = append(changed, m)
+			}
+		}
+	}
+	self.mutex.Unlock()
+	self.notify(changed)
+}
+
+// Takes in what another member said about u.Addr, if it's news, and passes
+// it on. Returns the member as it is now if it changed. Must hold mutex.
+func (self *Gossip) merge(u Member) (Member, bool) {
+	if u.Addr == self.self.Addr {
+		if u.Incarnation > self.self.Incarnation || (u.Incarnation == self.self.Incarnation && u.State != Alive) {
+			self.self.Incarnation = u.Incarnation + 1
+			self.queue(self.self)
+		}
+		return Member{}, false
+	}
+	m := self.members[u.Addr]
+	was := Dead
+	if m == nil {
+		if u.State == Dead {
+			return Member{}, false
+		}
+		m = &gossipMember{Member: u}
+		self.members[u.Addr] = m
+		i := rand.Intn(len(self.probeOrder) + 1)
+		self.probeOrder = append(self.probeOrder, "")
+		copy(self.probeOrder[i+1:], self.probeOrder[i:])
+		self.probeOrder[i] = u.Addr
+	} else {
+		// Higher incarnations win, and then the worse state
+		if u.Incarnation < m.Incarnation || (u.Incarnation == m.Incarnation && u.State <= m.State) {
+			return Member{}, false
+		}
+		if u.State != Alive {
+			u.Meta = m.Meta
+		}
+		was = m.State
+		m.Member = u
+	}
+	if u.State == Suspect {
+		m.suspectedAt = time.Now()
+	}
+	if u.State != was {
+		log.Println("Gossip: member", u.Addr, "is", u.State)
+	}
+	self.queue(m.Member)
+	return m.Member, true
+}
+
+// Must hold mutex
+func (self *Gossip) queue(m Member) {
+	for i, u := range self.updates {
+		if u.member.Addr == m.Addr {
+			self.updates = append(self.updates[:i], self.updates[i+1:]...)
+			break
+		}
+	}
+	self.updates = append(self.updates, &gossipUpdate{m, 0})
+}
+
+// The changes to send next, least sent first. Must hold mutex.
+func (self *Gossip) piggyback() []Member {
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(self.members)+2))))
+	sort.SliceStable(self.updates, func(i, j int) bool { return self.updates[i].sent < self.updates[j].sent })
+	var members []Member
+	var keep []*gossipUpdate
+	for _, u := range self.updates {
+		if len(members) < maxPiggyback {
+			members = append(members, u.member)
+			u.sent++
+		}
+		if u.sent < limit {
+			keep = append(keep, u)
+		}
+	}
+	self.updates = keep
+	return members
+}
+
+// A message with this member and every one it knows about
+func (self *Gossip) everything(kind string) gossipMsg {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	msg := gossipMsg{Type: kind, Updates: []Member{self.self}}
+	for _, m := range self.members {
+		msg.Updates = append(msg.Updates, m.Member)
+	}
+	return msg
+}
+
+func (self *Gossip) notify(changed []Member) {
+	if self.conf.Notify == nil {
+		return
+	}
+	for _, m := range changed {
+		self.conf.Notify(m)
+	}
+}
+
+// The next member to probe. Each is probed once, in a random order, before
+// any is probed again.
+func (self *Gossip) nextTarget() (string, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for range self.probeOrder {
+		if self.probeNext >= len(self.probeOrder) {
+			rand.Shuffle(len(self.probeOrder), func(i, j int) {
+				self.probeOrder[i], self.probeOrder[j] = self.probeOrder[j], self.probeOrder[i]
+			})
+			self.probeNext = 0
+		}
+		addr := self.probeOrder[self.probeNext]
+		self.probeNext++
+		if self.members[addr].State != Dead {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// Up to n members that are alive, besides except
+func (self *Gossip) randomMembers(n int, except string) []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var addrs []string
+	for addr, m := range self.members {
+		if m.State == Alive && addr != except {
+			addrs = append(addrs, addr)
+		}
+	}
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+func (self *Gossip) expectAck() (uint64, chan bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.seq++
+	acked := make(chan bool, 1)
+	self.acks[self.seq] = acked
+	return self.seq, acked
+}
+
+func (self *Gossip) forgetAck(seq uint64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.acks, seq)
+}
+
+func (self *Gossip) acked(seq uint64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if acked, ok := self.acks[seq]; ok {
+		select {
+		case acked <- true:
+		default:
+		}
+	}
+}
+
+func (self *Gossip) send(addr string, msg gossipMsg) {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		log.Println("Gossip:", err)
+		return
+	}
+	self.sendTo(to, msg)
+}
+
+// Changes are piggybacked on everything but syncs, which have them all
+func (self *Gossip) sendTo(to net.Addr, msg gossipMsg) {
+	if msg.Type != "sync" && msg.Type != "sync-ack" {
+		self.mutex.Lock()
+		msg.Updates = self.piggyback()
+		self.mutex.Unlock()
+	}
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := self.conf.Conn.WriteTo(data, to); err != nil && !self.isStopped() {
+		log.Println("Gossip to", to, "->", err)
+	}
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Consistent hashing for federated MetaDataNodes. Each one is placed on the
+// SHA-1 circle many times, and is in charge of whatever hashes to just
+// before one of its places. Blobs are placed by their ID and paths by their
+// top-level entry, so a directory tree stays on one MetaDataNode.
+
+// Places each member gets on the circle, so the ranges even out
+const ringReplicas = 64
+
+type HashRing struct {
+	members []string
+	points  []ringPoint // By hash
+}
+
+type ringPoint struct {
+	hash   [sha1.Size]byte
+	member string
+}
+
+func NewHashRing(members []string) *HashRing {
+	ring := &HashRing{members: append([]string{}, members...)}
+	for _, m := range members {
+		for i := 0; i < ringReplicas; i++ {
+			ring.points = append(ring.points, ringPoint{sha1.Sum([]byte(m + "#" + strconv.Itoa(i))), m})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return bytes.Compare(ring.points[i].hash[:], ring.points[j].hash[:]) < 0
+	})
+	return ring
+}
+
+func (self *HashRing) Members() []string {
+	return append([]string{}, self.members...)
+}
+
+// The member in charge of key, the first one clockwise from its hash
+func (self *HashRing) Owner(key string) string {
+	if len(self.points) == 0 {
+		return ""
+	}
+	hash := sha1.Sum([]byte(key))
+	i := sort.Search(len(self.points), func(i int) bool {
+		return bytes.Compare(self.points[i].hash[:], hash[:]) >= 0
+	})
+	if i == len(self.points) {
+		i = 0
+	}
+	return self.points[i].member
+}
+
+// Where a blob goes on the ring. A block goes with the blob it's part of.
+func BlobKey(id string) string {
+	return "blob:" + strings.SplitN(id, ":", 2)[0]
+}
+
+// Where a path goes on the ring. Empty for "/" and relative paths, which
+// aren't any one member's.
+func PathKey(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return ""
+	}
+	top := strings.SplitN(strings.TrimPrefix(path.Clean(p), "/"), "/", 2)[0]
+	if top == "" {
+		return ""
+	}
+	return "path:" + top
+}
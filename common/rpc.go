@@ -1,13 +1,46 @@
 package common
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"strings"
 
 	"net/rpc"
 	"net/rpc/jsonrpc"
 )
 
+// MetaDataNodes that aren't the leader fail calls with this, followed by the
+// leader's address if they know it
+const NotLeader = "Not the leader"
+
+func NotLeaderError(leader string) string {
+	if leader == "" {
+		return NotLeader
+	}
+	return NotLeader + ", try " + leader
+}
+
+// Whether err is a MetaDataNode sending the caller to the leader, and the
+// leader's address if it knew it. Only errors that are exactly what
+// NotLeaderError makes count, not ones that happen to mention NotLeader.
+func LeaderRedirect(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	msg := err.Error()
+	if msg == NotLeader {
+		return "", true
+	}
+	if !strings.HasPrefix(msg, NotLeader+", try ") {
+		return "", false
+	}
+	return strings.TrimPrefix(msg, NotLeader+", try "), true
+}
+
 type RPCServer struct {
 	codec             rpc.ServerCodec
 	lastServiceMethod string
@@ -62,3 +95,65 @@ func (self *RPCServer) Send(obj interface{}) error {
 	r.Error = ""
 	return self.codec.WriteResponse(&r, obj)
 }
+
+// Client side of the manual RPC loop. Unlike net/rpc's Client, it doesn't
+// read ahead, so a connection can carry raw block data after a response.
+type RPCClient struct {
+	sock    io.ReadWriteCloser
+	encoder *json.Encoder
+	decoder *json.Decoder
+	seq     uint64
+}
+
+type rpcClientRequest struct {
+	Method string         `json:"method"`
+	Params [1]interface{} `json:"params"`
+	Id     uint64         `json:"id"`
+}
+
+type rpcClientResponse struct {
+	Id     uint64           `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  interface{}      `json:"error"`
+}
+
+func NewRPCClient(sock io.ReadWriteCloser) *RPCClient {
+	return &RPCClient{sock, json.NewEncoder(sock), json.NewDecoder(sock), 0}
+}
+
+func (self *RPCClient) Call(method string, args interface{}, reply interface{}) error {
+	self.seq++
+	if err := self.encoder.Encode(&rpcClientRequest{method, [1]interface{}{args}, self.seq}); err != nil {
+		return err
+	}
+	var resp rpcClientResponse
+	if err := self.decoder.Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return errors.New(fmt.Sprint(resp.Error))
+	}
+	if reply == nil || resp.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(*resp.Result, reply)
+}
+
+// Data sent after the last response. Don't Call again after using this.
+func (self *RPCClient) Reader() io.Reader {
+	r := io.MultiReader(self.decoder.Buffered(), self.sock)
+	// Skip the newline the server's encoder writes after each response
+	b := make([]byte, 1)
+	if n, _ := io.ReadFull(r, b); n == 1 && b[0] != '\n' {
+		return io.MultiReader(bytes.NewReader(b), r)
+	}
+	return r
+}
+
+func (self *RPCClient) Write(p []byte) (int, error) {
+	return self.sock.Write(p)
+}
+
+func (self *RPCClient) Close() error {
+	return self.sock.Close()
+}
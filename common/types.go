@@ -1,13 +1,16 @@
 // Network protocol and other communications issues.
 package common
 
+import "time"
+
 type BlockID string
 type NodeID string
 
 type ForwardBlock struct {
-	BlockID BlockID
-	Nodes   []string
-	Size    int64
+	BlockID  BlockID
+	Nodes    []string
+	Size     int64
+	Checksum string // Algorithm, empty means CRC32 with a decimal checksum
 }
 
 type RegistrationMsg struct {
@@ -26,4 +29,134 @@ type HeartbeatResponse struct {
 	NeedToRegister   bool
 	InvalidateBlocks []BlockID
 	ToReplicate      []ForwardBlock
+	Standby          bool // Isn't in charge, so there's nothing to do
+}
+
+// Part of a block, for ranged reads
+type BlockRange struct {
+	BlockID BlockID
+	Offset  int64
+	Length  int64
+}
+
+type BlockInfo struct {
+	BlockID  BlockID
+	Size     int64  // -1 if unknown
+	Checksum string // Of the whole block, empty if unknown
+}
+
+// One checksum for the whole block, and one for each ChunkSize bytes of it
+// so that parts of the block can be verified
+type BlockChecksums struct {
+	Checksum  string
+	ChunkSize int64
+	Chunks    []string
+}
+
+// Sent before the data of a ranged read. The range is widened to whole
+// chunks, so Offset and Length may differ from what was asked for.
+type BlockRangeResponse struct {
+	Offset    int64
+	Length    int64
+	ChunkSize int64
+	Chunks    []string
+}
+
+type CreateBlobMsg struct {
+	Path      string // Optional, linked when the blob is committed
+	BlockSize int64  // Optional, the cluster default if 0
+	// Optional, the cluster default if 0
+	ReplicationFactor int
+}
+
+// Permission to add to an open blob. It has to be renewed before it expires
+// or the blob is abandoned.
+type Lease struct {
+	BlobID  string
+	Token   string
+	Expires time.Time
+	// Needed to take the upload over with ResumeBlob. Stays the same when
+	// it's resumed, unlike Token.
+	ResumeToken string
+}
+
+type ResumeMsg struct {
+	BlobID      string
+	ResumeToken string
+}
+
+// For Append and RenewLease
+type LeaseMsg struct {
+	BlobID string
+	Token  string
+}
+
+// Sent once a block is on its DataNodes, so an interrupted upload can resume
+// after it
+type AckBlockMsg struct {
+	BlobID   string
+	Token    string
+	Block    BlockInfo
+	Replicas []string // DataNodes that confirmed they have it
+}
+
+// Asks for DataNodes to make up a block's missing replicas, without the
+// nodes that failed
+type ReplaceTargetsMsg struct {
+	BlobID   string
+	Token    string
+	BlockID  BlockID
+	Excluded []string
+	Kept     []string // DataNodes that already have the block
+}
+
+// A new lease on an open blob, and the blocks acknowledged so far
+type ResumeResponse struct {
+	Lease  Lease
+	Blocks []BlockInfo
+}
+
+// The blocks in the blob, in order. Blocks that were appended but aren't
+// listed are deleted.
+type CommitMsg struct {
+	BlobID string
+	Token  string
+	Blocks []BlockInfo
+}
+
+type FileInfo struct {
+	Path        string
+	IsDir       bool
+	BlobID      string
+	Size        int64
+	BlockSize   int64 // Every block but the last is this big, 0 if unknown
+	Replication int
+}
+
+// A blob's metadata. State is "open" while it's being uploaded, then
+// "committed". Times are zero if they weren't recorded.
+type BlobInfo struct {
+	BlobID      string
+	Size        int64
+	BlockSize   int64
+	Replication int
+	Created     time.Time
+	Committed   time.Time
+	State       string
+	Blocks      []BlockInfo
+}
+
+type SetReplicationMsg struct {
+	BlobID            string
+	ReplicationFactor int
+}
+
+type RenameMsg struct {
+	From string
+	To   string
+}
+
+type DeleteMsg struct {
+	Path      string
+	Recursive bool
 }
@@ -30,6 +30,15 @@ type BlockIntents struct {
 
 // TODO:
 
+// For the blocks already on disk when the DataNode starts
+func (self *BlockIntents) MarkExisting(blocks []BlockID) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, block := range blocks {
+		self.exists[block] = true
+	}
+}
+
 func (self *BlockIntents) LockReceive(block BlockID) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -1,12 +1,14 @@
 package datanode
 
 import (
-	"fmt"
-	"hash/crc32"
+	"errors"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 
 	. "golang-distributed-filesystem/common"
 )
@@ -24,18 +26,25 @@ func (self *BlockStore) BlockSize(block BlockID) (int64, error) {
 	return fileInfo.Size(), nil
 }
 
-func (self *BlockStore) LocalChecksum(block BlockID) (string, error) {
+// Checksums the block on disk. chunkSize 0 means only the whole-block checksum.
+func (self *BlockStore) LocalChecksums(block BlockID, algorithm string, chunkSize int64) (BlockChecksums, error) {
 	file, err := os.Open(self.BlockFilename(block))
 	if err != nil {
-		return "", err
+		return BlockChecksums{}, err
 	}
 	defer file.Close()
 
-	hash := crc32.NewIEEE()
+	if chunkSize <= 0 {
+		chunkSize = math.MaxInt64
+	}
+	hash, err := newChunkHasher(algorithm, chunkSize)
+	if err != nil {
+		return BlockChecksums{}, err
+	}
 	if _, err = io.Copy(hash, file); err != nil {
-		return "", err
+		return BlockChecksums{}, err
 	}
-	return fmt.Sprint(hash.Sum32()), nil
+	return hash.Checksums(), nil
 }
 
 func (self *BlockStore) ReadBlock(block BlockID, w io.Writer) error {
@@ -51,19 +60,39 @@ func (self *BlockStore) ReadBlock(block BlockID, w io.Writer) error {
 	return nil
 }
 
-func (self *BlockStore) WriteBlock(block BlockID, size int64, r io.Reader) (string, error) {
+func (self *BlockStore) ReadBlockRange(block BlockID, offset int64, length int64, w io.Writer) error {
+	file, err := os.Open(self.BlockFilename(block))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, file, length)
+	return err
+}
+
+func (self *BlockStore) WriteBlock(block BlockID, size int64, algorithm string, r io.Reader) (BlockChecksums, error) {
+	hash, err := newChunkHasher(algorithm, chunkSize)
+	if err != nil {
+		return BlockChecksums{}, err
+	}
 	file, err := os.Create(self.BlockFilename(block))
 	if err != nil {
-		return "", err
+		return BlockChecksums{}, err
 	}
 	defer file.Close()
 
-	hash := crc32.NewIEEE()
 	_, err = io.CopyN(file, io.TeeReader(r, hash), size)
 	if err != nil {
-		return "", err
+		return BlockChecksums{}, err
+	}
+	// Confirming the block means it's on disk
+	if err := file.Sync(); err != nil {
+		return BlockChecksums{}, err
 	}
-	return fmt.Sprint(hash.Sum32()), nil
+	return hash.Checksums(), nil
 }
 
 func (self *BlockStore) ReadBlockList() ([]BlockID, error) {
@@ -82,15 +111,32 @@ func (self *BlockStore) BlocksDirectory() string {
 	return path.Join(self.DataDir, "blocks")
 }
 
-func (self *BlockStore) ReadChecksum(block BlockID) (string, error) {
+// The meta file has the block checksum, then the chunk size and one line per
+// chunk. Older meta files only have the block checksum, in decimal. Each
+// checksum records its algorithm (see common.FormatChecksum).
+func (self *BlockStore) ReadChecksums(block BlockID) (BlockChecksums, error) {
 	b, err := ioutil.ReadFile(self.ChecksumFilename(block))
 	if err != nil {
-		return "", err
+		return BlockChecksums{}, err
 	}
-	return string(b), nil
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	sums := BlockChecksums{Checksum: lines[0]}
+	if len(lines) > 1 {
+		sums.ChunkSize, err = strconv.ParseInt(lines[1], 10, 64)
+		if err != nil || sums.ChunkSize <= 0 {
+			return BlockChecksums{}, errors.New("Bad chunk size in " + self.ChecksumFilename(block))
+		}
+		sums.Chunks = lines[2:]
+	}
+	return sums, nil
 }
-func (self *BlockStore) WriteChecksum(block BlockID, s string) error {
-	return ioutil.WriteFile(self.ChecksumFilename(block), []byte(s), 0777)
+func (self *BlockStore) WriteChecksums(block BlockID, sums BlockChecksums) error {
+	lines := []string{sums.Checksum}
+	if sums.ChunkSize > 0 {
+		lines = append(lines, strconv.FormatInt(sums.ChunkSize, 10))
+		lines = append(lines, sums.Chunks...)
+	}
+	return ioutil.WriteFile(self.ChecksumFilename(block), []byte(strings.Join(lines, "\n")+"\n"), 0777)
 }
 
 func (self *BlockStore) MetaDirectory() string {
@@ -0,0 +1,69 @@
+package datanode
+
+import (
+	"hash"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Bytes covered by each chunk checksum of new blocks
+const chunkSize = 64 * 1024
+
+// Checksums data as it's written, a chunk at a time
+type chunkHasher struct {
+	algorithm string
+	chunkSize int64
+	whole     hash.Hash
+	chunk     hash.Hash
+	inChunk   int64
+	chunks    []string
+}
+
+func newChunkHasher(algorithm string, chunkSize int64) (*chunkHasher, error) {
+	whole, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	chunk, _ := NewChecksumHash(algorithm)
+	return &chunkHasher{algorithm, chunkSize, whole, chunk, 0, nil}, nil
+}
+
+func (self *chunkHasher) Write(p []byte) (int, error) {
+	self.whole.Write(p)
+	n := len(p)
+	for len(p) > 0 {
+		m := self.chunkSize - self.inChunk
+		if m > int64(len(p)) {
+			m = int64(len(p))
+		}
+		self.chunk.Write(p[:m])
+		self.inChunk += m
+		p = p[m:]
+		if self.inChunk == self.chunkSize {
+			self.endChunk()
+		}
+	}
+	return n, nil
+}
+
+func (self *chunkHasher) endChunk() {
+	self.chunks = append(self.chunks, FormatChecksum(self.algorithm, self.chunk))
+	self.chunk.Reset()
+	self.inChunk = 0
+}
+
+func (self *chunkHasher) Checksums() BlockChecksums {
+	if self.inChunk > 0 {
+		self.endChunk()
+	}
+	return BlockChecksums{FormatChecksum(self.algorithm, self.whole), self.chunkSize, self.chunks}
+}
+
+// Blocks from before chunk checksums have one checksum for the whole thing,
+// which works the same as a single chunk.
+func wholeBlockChunks(sums BlockChecksums, size int64) BlockChecksums {
+	if sums.ChunkSize > 0 || size == 0 {
+		return sums
+	}
+	return BlockChecksums{sums.Checksum, size, []string{sums.Checksum}}
+}
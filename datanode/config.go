@@ -11,5 +11,29 @@ type Config struct {
 	Debug             bool
 	Listener          net.Listener
 	HeartbeatInterval time.Duration
-	LeaderAddress     string
+	// How often every block is checked against its checksums. Defaults to 5
+	// seconds.
+	IntegrityInterval time.Duration
+	// How long a write to the next DataNode in a pipeline can take before
+	// it's left out. Defaults to 30 seconds.
+	PipelineTimeout time.Duration
+	LeaderAddress   string
+	// Cluster addresses of the other MetaDataNodes in a Raft cluster, asked
+	// in turn who leads when the ones before them can't be reached
+	MetaDataNodes []string
+	// Cluster addresses of the other MetaDataNodes in a federation. Blocks
+	// are stored for all of them, and each is told about every block.
+	Federation []string
+	// Standby MetaDataNodes, which are registered and heartbeated with like
+	// the leader so they know where blocks are if one is promoted. Only a
+	// MetaDataNode that isn't a standby is obeyed.
+	Standbys []string
+	// Gossips with the other DataNodes and the MetaDataNodes over this,
+	// spreading how much space it uses. A MetaDataNode that gossips is only
+	// heartbeated when there are blocks to report or it's waiting to hear
+	// from this DataNode.
+	GossipListener   net.PacketConn
+	GossipSeeds      []string
+	ProbeInterval    time.Duration // Defaults to 1 second
+	SuspicionTimeout time.Duration // Defaults to 5 probe intervals
 }
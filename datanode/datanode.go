@@ -1,6 +1,7 @@
 package datanode
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
@@ -18,17 +19,31 @@ var (
 
 type DataNodeState struct {
 	mutex             sync.Mutex
-	newBlocks         []BlockID
 	forwardingBlocks  chan ForwardBlock
-	NodeID            NodeID
+	nodeID            NodeID // From the leader
 	Store             BlockStore
 	Manager           BlockIntents
 	heartbeatInterval time.Duration
+	integrityInterval time.Duration
+	pipelineTimeout   time.Duration
 	Addr              string
-	LeaderAddress     string
+	metaDataNodes     []*metaDataNode // The leader, then any others
+	gossip            *Gossip         // Nil without gossip
+	listener          net.Listener
+	stopped           bool
 
 	blocksToDelete chan BlockID
-	deadBlocks     []BlockID
+}
+
+// One of the MetaDataNodes this DataNode heartbeats, and the block changes
+// it hasn't heard about yet
+type metaDataNode struct {
+	address    string   // Changes when another MetaDataNode is leading
+	configured []string // Where to ask who leads
+	next       int      // The configured address to ask after this one
+	nodeID     NodeID
+	newBlocks  []BlockID
+	deadBlocks []BlockID
 }
 
 func Create(conf Config) (*DataNodeState, error) {
@@ -40,12 +55,29 @@ func Create(conf Config) (*DataNodeState, error) {
 	dn.Manager.willDelete = map[BlockID]bool{}
 	dn.Manager.exists = map[BlockID]bool{}
 
-	Debug = conf.Debug
+	// Shared by every DataNode in the process, and read by their heartbeats,
+	// so it's only ever turned on
+	if conf.Debug {
+		Debug = true
+	}
 
 	dn.Store.DataDir = conf.DataDir
 	dn.Addr = conf.Listener.Addr().String()
+	dn.listener = conf.Listener
 	dn.heartbeatInterval = conf.HeartbeatInterval
-	dn.LeaderAddress = conf.LeaderAddress
+	dn.integrityInterval = conf.IntegrityInterval
+	if dn.integrityInterval == 0 {
+		dn.integrityInterval = 5 * time.Second
+	}
+	dn.pipelineTimeout = conf.PipelineTimeout
+	if dn.pipelineTimeout == 0 {
+		dn.pipelineTimeout = 30 * time.Second
+	}
+	leader := append([]string{conf.LeaderAddress}, conf.MetaDataNodes...)
+	dn.metaDataNodes = append(dn.metaDataNodes, &metaDataNode{address: conf.LeaderAddress, configured: leader, next: 1})
+	for _, addr := range append(append([]string{}, conf.Federation...), conf.Standbys...) {
+		dn.metaDataNodes = append(dn.metaDataNodes, &metaDataNode{address: addr, configured: []string{addr}})
+	}
 
 	log.Print("Block storage in directory '" + dn.Store.BlocksDirectory() + "'")
 	if err := os.MkdirAll(dn.Store.BlocksDirectory(), 0777); err != nil {
@@ -56,9 +88,27 @@ func Create(conf Config) (*DataNodeState, error) {
 	if err := os.MkdirAll(dn.Store.MetaDirectory(), 0777); err != nil {
 		log.Fatal("Making directory:", err)
 	}
+	blocks, err := dn.Store.ReadBlockList()
+	if err != nil {
+		log.Fatalln("Getting blocklist:", err)
+	}
+	dn.Manager.MarkExisting(blocks)
+
+	if conf.GossipListener != nil {
+		dn.gossip = NewGossip(GossipConfig{
+			Conn:             conf.GossipListener,
+			Seeds:            conf.GossipSeeds,
+			Meta:             GossipMeta{DataNode: dn.Addr},
+			ProbeInterval:    conf.ProbeInterval,
+			SuspicionTimeout: conf.SuspicionTimeout,
+		})
+		go dn.gossipSpaceUsed()
+	}
 
 	go dn.RPCServer(conf.Listener)
-	go dn.Heartbeat()
+	for _, mdn := range dn.metaDataNodes {
+		go dn.heartbeat(mdn)
+	}
 	go dn.IntegrityChecker()
 	go dn.BlockForwarder()
 
@@ -66,15 +116,27 @@ func Create(conf Config) (*DataNodeState, error) {
 }
 
 func (self *DataNodeState) HaveBlocks(blockIDs []BlockID) {
+	for _, mdn := range self.metaDataNodes {
+		self.haveBlocks(mdn, blockIDs)
+	}
+}
+
+func (self *DataNodeState) haveBlocks(mdn *metaDataNode, blockIDs []BlockID) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
-	self.newBlocks = append(self.newBlocks, blockIDs...)
+	mdn.newBlocks = append(mdn.newBlocks, blockIDs...)
 }
 
 func (self *DataNodeState) DontHaveBlocks(blockIDs []BlockID) {
+	for _, mdn := range self.metaDataNodes {
+		self.dontHaveBlocks(mdn, blockIDs)
+	}
+}
+
+func (self *DataNodeState) dontHaveBlocks(mdn *metaDataNode, blockIDs []BlockID) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
-	self.deadBlocks = append(self.deadBlocks, blockIDs...)
+	mdn.deadBlocks = append(mdn.deadBlocks, blockIDs...)
 }
 
 func (self *DataNodeState) RemoveBlock(block BlockID) {
@@ -87,75 +149,140 @@ func (self *DataNodeState) RemoveBlock(block BlockID) {
 	self.DontHaveBlocks([]BlockID{block})
 }
 
-func (self *DataNodeState) DrainNewBlocks() []BlockID {
+func (self *DataNodeState) drainNewBlocks(mdn *metaDataNode) []BlockID {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
-	newBlocks := self.newBlocks
-	self.newBlocks = []BlockID{}
+	newBlocks := mdn.newBlocks
+	mdn.newBlocks = []BlockID{}
 	return newBlocks
 }
 
-func (self *DataNodeState) DrainDeadBlocks() []BlockID {
+func (self *DataNodeState) drainDeadBlocks(mdn *metaDataNode) []BlockID {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
-	deadBlocks := self.deadBlocks
-	self.deadBlocks = []BlockID{}
+	deadBlocks := mdn.deadBlocks
+	mdn.deadBlocks = []BlockID{}
 	return deadBlocks
 }
 
-func (self *DataNodeState) Heartbeat() {
-	for {
-		tick(self)
+// Each MetaDataNode is heartbeated on its own, so one that's down doesn't
+// hold up the others
+func (self *DataNodeState) heartbeat(mdn *metaDataNode) {
+	for !self.isStopped() {
+		if !self.quiet(mdn) {
+			tick(self, mdn)
+		}
 		time.Sleep(self.heartbeatInterval)
 	}
 }
 
+// Stops serving, heartbeating and gossiping, as if the process had died.
+// The blocks stay on disk.
+func (self *DataNodeState) Stop() {
+	self.mutex.Lock()
+	self.stopped = true
+	self.mutex.Unlock()
+	self.listener.Close()
+	if self.gossip != nil {
+		self.gossip.Stop()
+	}
+}
+
+func (self *DataNodeState) isStopped() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.stopped
+}
+
 func (self *DataNodeState) BlockForwarder() {
 	for {
 		f := <-self.forwardingBlocks
-		sendBlock(self, f.BlockID, f.Nodes)
+		if _, err := sendBlock(self, f.BlockID, f.Nodes); err != nil {
+			log.Println("Replicating block '"+string(f.BlockID)+"':", err)
+		}
 	}
 }
 
 func (self *DataNodeState) IntegrityChecker() {
 	for {
-		time.Sleep(5 * time.Second)
-		log.Println("Checking block integrity...")
-		files, err := self.Store.ReadBlockList()
-		if err != nil {
-			log.Fatal("Reading directory '"+self.Store.BlocksDirectory()+"': ", err)
+		time.Sleep(self.integrityInterval)
+		if self.isStopped() {
+			return
+		}
+		self.CheckIntegrity()
+	}
+}
+
+// Removes blocks that don't match their checksums, so the MetaDataNode
+// replicates them from elsewhere. Returns what was wrong with each one.
+func (self *DataNodeState) CheckIntegrity() map[BlockID]error {
+	log.Println("Checking block integrity...")
+	files, err := self.Store.ReadBlockList()
+	if err != nil {
+		log.Fatal("Reading directory '"+self.Store.BlocksDirectory()+"': ", err)
+	}
+	corrupt := map[BlockID]error{}
+	for _, f := range files {
+		if err := self.Manager.LockRead(f); err != nil {
+			// Being uploaded or deleted
+			// May or may not actually exist now/in the future
+			// Does not imply it actually exists!
+			continue
+		}
+		if err := self.checkBlock(f); err != nil {
+			log.Println("Block '"+string(f)+"' is corrupt:", err)
+			corrupt[f] = err
+			go self.RemoveBlock(f)
 		}
-		for _, f := range files {
-			if err := self.Manager.LockRead(f); err != nil {
-				// Being uploaded or deleted
-				// May or may not actually exist now/in the future
-				// Does not imply it actually exists!
-				continue
-			}
-			storedChecksum, err := self.Store.ReadChecksum(f)
-			if err != nil {
-				go self.RemoveBlock(BlockID(f))
-			}
-			localChecksum, err := self.Store.LocalChecksum(f)
-			if err != nil {
-				go self.RemoveBlock(BlockID(f))
-			}
-
-			if storedChecksum != localChecksum {
-				log.Println("Checksum doesn't match block:", f)
-				log.Println(storedChecksum, localChecksum)
-				go self.RemoveBlock(BlockID(f))
-			}
-			self.Manager.UnlockRead(f)
+		self.Manager.UnlockRead(f)
+	}
+	return corrupt
+}
+
+// The chunks of a block that don't match their checksums. A block from
+// before chunk checksums is one chunk.
+type CorruptBlockError struct {
+	Block  BlockID
+	Chunks []int
+}
+
+func (self *CorruptBlockError) Error() string {
+	return fmt.Sprint("Chunks ", self.Chunks, " don't match their checksums")
+}
+
+// Compares the block against its stored checksums. Must hold a read lock.
+func (self *DataNodeState) checkBlock(block BlockID) error {
+	stored, err := self.Store.ReadChecksums(block)
+	if err != nil {
+		return err
+	}
+	local, err := self.Store.LocalChecksums(block, ChecksumAlgorithm(stored.Checksum), stored.ChunkSize)
+	if err != nil {
+		return err
+	}
+	if ChecksumsEqual(stored.Checksum, local.Checksum) {
+		return nil
+	}
+	corrupt := &CorruptBlockError{block, nil}
+	for i, sum := range stored.Chunks {
+		if i >= len(local.Chunks) || !ChecksumsEqual(sum, local.Chunks[i]) {
+			corrupt.Chunks = append(corrupt.Chunks, i)
 		}
 	}
+	if len(corrupt.Chunks) == 0 {
+		corrupt.Chunks = []int{0}
+	}
+	return corrupt
 }
 
-func tick(dn *DataNodeState) {
-	conn, err := net.Dial("tcp", dn.LeaderAddress)
+func tick(dn *DataNodeState, mdn *metaDataNode) {
+	conn, err := net.Dial("tcp", mdn.address)
 	if err != nil {
-		log.Println("Couldn't connect to leader at", dn.LeaderAddress)
-		dn.NodeID = ""
+		log.Println("Couldn't connect to MetaDataNode at", mdn.address)
+		dn.setNodeID(mdn, "")
+		// Ask the next MetaDataNode we were given who leads now
+		mdn.address = mdn.configured[mdn.next%len(mdn.configured)]
+		mdn.next++
 		return
 	}
 	codec := jsonrpc.NewClientCodec(conn)
@@ -168,22 +295,21 @@ func tick(dn *DataNodeState) {
 	defer client.Close()
 
 	log.Println("Heartbeat...")
-	if len(dn.NodeID) == 0 {
+	nodeID := dn.nodeIDFor(mdn)
+	if len(nodeID) == 0 {
 		log.Println("Re-reading blocklist")
 		blocks, err := dn.Store.ReadBlockList()
 		if err != nil {
 			log.Fatalln("Getting blocklist:", err)
 		}
-		for _, b := range blocks {
-			// Seems hacky
-			dn.Manager.exists[b] = true
-		}
-		err = client.Call("Register", &RegistrationMsg{dn.Addr, blocks}, &dn.NodeID)
+		err = client.Call("Register", &RegistrationMsg{dn.Addr, blocks}, &nodeID)
 		if err != nil {
 			log.Println("Registration error:", err)
+			dn.followLeader(mdn, err)
 			return
 		}
-		log.Println("Registered with ID:", dn.NodeID)
+		dn.setNodeID(mdn, nodeID)
+		log.Println("Registered with", mdn.address, "with ID:", nodeID)
 		return
 	}
 
@@ -193,24 +319,28 @@ func tick(dn *DataNodeState) {
 		log.Fatalln("Getting utilization:", err)
 	}
 	spaceUsed := len(blocks)
-	newBlocks := dn.DrainNewBlocks()
-	deadBlocks := dn.DrainDeadBlocks()
+	newBlocks := dn.drainNewBlocks(mdn)
+	deadBlocks := dn.drainDeadBlocks(mdn)
 	var resp HeartbeatResponse
 
 	err = client.Call("Heartbeat",
-		HeartbeatMsg{dn.NodeID, spaceUsed, newBlocks, deadBlocks},
+		HeartbeatMsg{nodeID, spaceUsed, newBlocks, deadBlocks},
 		&resp)
 	if err != nil {
 		log.Println("Heartbeat error:", err)
-		dn.HaveBlocks(newBlocks)
-		dn.DontHaveBlocks(deadBlocks)
+		dn.haveBlocks(mdn, newBlocks)
+		dn.dontHaveBlocks(mdn, deadBlocks)
+		dn.followLeader(mdn, err)
 		return
 	}
 	if resp.NeedToRegister {
-		log.Println("Re-registering with leader...")
-		dn.NodeID = ""
-		dn.HaveBlocks(newBlocks) // Try again next heartbeat
-		dn.DontHaveBlocks(deadBlocks)
+		log.Println("Re-registering with", mdn.address, "...")
+		dn.setNodeID(mdn, "")
+		dn.haveBlocks(mdn, newBlocks) // Try again next heartbeat
+		dn.dontHaveBlocks(mdn, deadBlocks)
+		return
+	}
+	if resp.Standby {
 		return
 	}
 	for _, blockID := range resp.InvalidateBlocks {
@@ -223,3 +353,41 @@ func tick(dn *DataNodeState) {
 		}
 	}()
 }
+
+// Registers with the leader on the next heartbeat if err was a MetaDataNode
+// redirecting us to it
+func (self *DataNodeState) followLeader(mdn *metaDataNode, err error) {
+	leader, ok := LeaderRedirect(err)
+	if !ok {
+		return
+	}
+	self.setNodeID(mdn, "")
+	// Between leaders, the same MetaDataNode is asked again
+	if leader != "" {
+		log.Println("Following the leader to", leader)
+		mdn.address = leader
+	}
+}
+
+// The leader's ID for this DataNode, empty until it's registered
+func (self *DataNodeState) NodeID() NodeID {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.nodeID
+}
+
+func (self *DataNodeState) nodeIDFor(mdn *metaDataNode) NodeID {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return mdn.nodeID
+}
+
+// The DataNode's own ID is the one from the leader
+func (self *DataNodeState) setNodeID(mdn *metaDataNode, nodeID NodeID) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	mdn.nodeID = nodeID
+	if mdn == self.metaDataNodes[0] {
+		self.nodeID = nodeID
+	}
+}
@@ -0,0 +1,51 @@
+package datanode
+
+import (
+	"log"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Tells the other members how much space is used, every heartbeat interval,
+// instead of heartbeating it to the MetaDataNodes
+func (self *DataNodeState) gossipSpaceUsed() {
+	for !self.isStopped() {
+		// Could be cached so we don't have to hit the filesystem
+		blocks, err := self.Store.ReadBlockList()
+		if err != nil {
+			log.Fatalln("Getting utilization:", err)
+		}
+		self.gossip.SetMeta(GossipMeta{DataNode: self.Addr, SpaceUsed: len(blocks)})
+		time.Sleep(self.heartbeatInterval)
+	}
+}
+
+// Whether there's no need to heartbeat the MetaDataNode: it hears from this
+// DataNode through gossip, there are no blocks to tell it about, and it isn't
+// waiting for commands to be picked up
+func (self *DataNodeState) quiet(mdn *metaDataNode) bool {
+	if self.gossip == nil {
+		return false
+	}
+	self.mutex.Lock()
+	// Registering goes through a heartbeat too
+	news := len(mdn.nodeID) == 0 || len(mdn.newBlocks) > 0 || len(mdn.deadBlocks) > 0
+	self.mutex.Unlock()
+	if news {
+		return false
+	}
+	for _, m := range self.gossip.Members() {
+		if m.Meta.MetaDataNode != mdn.address || m.State == Dead {
+			continue
+		}
+		for _, addr := range m.Meta.Waiting {
+			if addr == self.Addr {
+				return false
+			}
+		}
+		return true
+	}
+	// It doesn't gossip
+	return false
+}
@@ -0,0 +1,76 @@
+package datanode
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// The next DataNode in a pipeline. It's sent the block as it's read, so the
+// replicas are written at the same time.
+type pipelinePeer struct {
+	addr    string
+	conn    net.Conn
+	client  *rpc.Client
+	timeout time.Duration // For each write
+	err     error         // The first failed write
+}
+
+// Connects to the first peer that answers and tells it to expect the block.
+// It forwards to the rest.
+func dialPipeline(blockID BlockID, peers []string, size int64, algorithm string, timeout time.Duration) (*pipelinePeer, error) {
+	for i, addr := range peers {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			continue
+		}
+		forwardTo := append(append([]string{}, peers[:i]...), peers[i+1:]...)
+
+		codec := jsonrpc.NewClientCodec(conn)
+		if Debug {
+			codec = LoggingClientCodec(conn.RemoteAddr().String(), codec)
+		}
+		client := rpc.NewClientWithCodec(codec)
+		if err := client.Call("Forward", &ForwardBlock{blockID, forwardTo, size, algorithm}, nil); err != nil {
+			log.Println("Forward to", addr, "error:", err)
+			client.Close()
+			continue
+		}
+		return &pipelinePeer{addr, conn, client, timeout, nil}, nil
+	}
+	return nil, errors.New("Couldn't forward block " + string(blockID) +
+		" to any DataNodes in: " + strings.Join(peers, " "))
+}
+
+// Never fails, so that a broken peer doesn't stop the local copy. A peer
+// that stops reading times out and is given up on the same way.
+func (self *pipelinePeer) Write(p []byte) (int, error) {
+	if self.err == nil {
+		self.conn.SetWriteDeadline(time.Now().Add(self.timeout))
+		_, self.err = self.conn.Write(p)
+	}
+	return len(p), nil
+}
+
+// Returns the peers that have the block, once they all do
+func (self *pipelinePeer) Confirm(checksum string) ([]string, error) {
+	if self.err != nil {
+		return nil, errors.New("Copying error: " + self.err.Error())
+	}
+	var replicas []string
+	if err := self.client.Call("Confirm", checksum, &replicas); err != nil {
+		return nil, errors.New("Confirm error: " + err.Error())
+	}
+	return append([]string{self.addr}, replicas...), nil
+}
+
+// Without confirming, the peer throws the block away
+func (self *pipelinePeer) Close() error {
+	return self.client.Close()
+}
@@ -1,74 +1,41 @@
 package datanode
 
 import (
+	"errors"
+	"io"
 	"log"
 	"net"
-	"net/rpc"
-	"net/rpc/jsonrpc"
-	"strings"
 
 	. "golang-distributed-filesystem/common"
 )
 
-func sendBlock(dn *DataNodeState, blockID BlockID, peers []string) {
+// Sends a block down a pipeline of peers. Returns the peers that confirmed
+// they have it, once they all have.
+func sendBlock(dn *DataNodeState, blockID BlockID, peers []string) ([]string, error) {
 	if err := dn.Manager.LockRead(blockID); err != nil {
-		log.Println("Couldn't lock", blockID)
-		return
+		return nil, errors.New("Couldn't lock " + string(blockID))
 	}
 	defer dn.Manager.UnlockRead(blockID)
 
-	var peerConn net.Conn
-	var forwardTo []string
-	var err error
-	// Find an online peer
-	for i, addr := range peers {
-		peerConn, err = net.Dial("tcp", addr)
-		if err == nil {
-			forwardTo = append(peers[:i], peers[i+1:]...)
-			break
-		}
-	}
-	if peerConn == nil {
-		log.Println("Couldn't forward block",
-			blockID,
-			"to any DataNodes in:",
-			strings.Join(peers, " "))
-		return
-	}
-	peerCodec := jsonrpc.NewClientCodec(peerConn)
-	if Debug {
-		peerCodec = LoggingClientCodec(
-			peerConn.RemoteAddr().String(),
-			peerCodec)
-	}
-	peer := rpc.NewClientWithCodec(peerCodec)
-	defer peer.Close()
-
 	size, err := dn.Store.BlockSize(blockID)
 	if err != nil {
-		log.Fatal("Stat error: ", err)
+		return nil, errors.New("Stat error: " + err.Error())
 	}
-
-	err = peer.Call("Forward",
-		&ForwardBlock{blockID, forwardTo, size},
-		nil)
+	sums, err := dn.Store.ReadChecksums(blockID)
 	if err != nil {
-		log.Fatal("Forward error: ", err)
+		return nil, errors.New("Reading checksum: " + err.Error())
 	}
 
-	err = dn.Store.ReadBlock(blockID, peerConn)
+	peer, err := dialPipeline(blockID, peers, size, ChecksumAlgorithm(sums.Checksum), dn.pipelineTimeout)
 	if err != nil {
-		log.Fatal("Copying error: ", err)
+		return nil, err
 	}
+	defer peer.Close()
 
-	hash, err := dn.Store.ReadChecksum(blockID)
-	if err != nil {
-		log.Fatalln("Reading checksum:", err)
-	}
-	err = peer.Call("Confirm", hash, nil)
-	if err != nil {
-		log.Fatal("Confirm error: ", err)
+	if err := dn.Store.ReadBlock(blockID, peer); err != nil {
+		return nil, errors.New("Copying error: " + err.Error())
 	}
+	return peer.Confirm(sums.Checksum)
 }
 
 func RunRPC(c net.Conn, dn *DataNodeState) {
@@ -95,13 +62,34 @@ func RunRPC(c net.Conn, dn *DataNodeState) {
 			server.Error("Size must be >0")
 			return
 		}
+		algorithm := blockMsg.Checksum
+		if algorithm == "" {
+			algorithm = CRC32
+		}
+		if _, err := NewChecksumHash(algorithm); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		// Pipeline! The next hop gets the block while we write it
+		var data io.Reader = c
+		var peer *pipelinePeer
+		if len(forwardTo) > 0 {
+			peer, err = dialPipeline(blockID, forwardTo, size, algorithm, dn.pipelineTimeout)
+			if err != nil {
+				log.Println("Pipelining block '"+string(blockID)+"':", err)
+			} else {
+				defer peer.Close()
+				data = io.TeeReader(c, peer)
+			}
+		}
 		dn.Manager.LockReceive(blockID)
 		server.SendOkay()
 
-		localChecksum, err := dn.Store.WriteBlock(
+		localChecksums, err := dn.Store.WriteBlock(
 			blockID,
 			size,
-			c)
+			algorithm,
+			data)
 		if err != nil {
 			log.Println("Writing block:", err)
 			server.Error("Writing block")
@@ -128,28 +116,33 @@ func RunRPC(c net.Conn, dn *DataNodeState) {
 			dn.Store.DeleteBlock(blockID)
 			return
 		}
-		if remoteChecksum != localChecksum {
+		if !ChecksumsEqual(remoteChecksum, localChecksums.Checksum) {
 			dn.Manager.AbortReceive(blockID)
 			dn.Store.DeleteBlock(blockID)
 			log.Println("Checksum doesn't match for", blockID)
 			server.Error("Checksum doesn't match")
 			return
 		}
-		if err := dn.Store.WriteChecksum(blockID, remoteChecksum); err != nil {
+		if err := dn.Store.WriteChecksums(blockID, localChecksums); err != nil {
 			dn.Manager.AbortReceive(blockID)
 			dn.Store.DeleteBlock(blockID)
 			log.Fatalln("Couldn't write checksum:", err)
 			server.Error("Couldn't write checksum")
 			return
 		}
-		server.SendOkay()
 		dn.Manager.CommitReceive(blockID)
 		// Combine into Block Manager?
 		dn.HaveBlocks([]BlockID{blockID})
-		// Pipeline!
-		if len(forwardTo) > 0 {
-			dn.forwardingBlocks <- ForwardBlock{blockID, forwardTo, -1}
+		// Only confirm once everybody downstream has it too
+		replicas := []string{}
+		if peer != nil {
+			downstream, err := peer.Confirm(remoteChecksum)
+			if err != nil {
+				log.Println("Pipelining block '"+string(blockID)+"':", err)
+			}
+			replicas = append(replicas, downstream...)
 		}
+		server.Send(&replicas)
 
 	case "Get":
 		var blockID BlockID
@@ -162,9 +155,74 @@ func RunRPC(c net.Conn, dn *DataNodeState) {
 			return
 		}
 		defer dn.Manager.UnlockRead(blockID)
-		server.SendOkay()
+		sums, err := dn.Store.ReadChecksums(blockID)
+		if err != nil {
+			log.Println("Reading checksum:", err)
+			server.Error("Couldn't read checksum")
+			return
+		}
+		// Client verifies the data against these
+		server.Send(&sums)
 		if err := dn.Store.ReadBlock(blockID, c); err != nil {
-			log.Fatalln("Copying error: ", err)
+			log.Println("Copying error:", err)
+			return
+		}
+
+	case "GetRange":
+		var blockRange BlockRange
+		if err := server.ReadBody(&blockRange); err != nil {
+			log.Println(err)
+			return
+		}
+		blockID := blockRange.BlockID
+		if err := dn.Manager.LockRead(blockID); err != nil {
+			server.Error("Couldn't get read lock")
+			return
+		}
+		defer dn.Manager.UnlockRead(blockID)
+		size, err := dn.Store.BlockSize(blockID)
+		if err != nil {
+			log.Println("Stat error:", err)
+			server.Error("Couldn't stat block")
+			return
+		}
+		if blockRange.Offset < 0 || blockRange.Length < 0 || blockRange.Offset > size {
+			server.Error("Range out of bounds")
+			return
+		}
+		sums, err := dn.Store.ReadChecksums(blockID)
+		if err != nil {
+			log.Println("Reading checksum:", err)
+			server.Error("Couldn't read checksum")
+			return
+		}
+		sums = wholeBlockChunks(sums, size)
+		end := blockRange.Offset + blockRange.Length
+		if end > size {
+			end = size
+		}
+		// Widen to whole chunks so the client can check them
+		var resp BlockRangeResponse
+		resp.ChunkSize = sums.ChunkSize
+		if resp.ChunkSize > 0 {
+			first := blockRange.Offset / resp.ChunkSize
+			last := (end + resp.ChunkSize - 1) / resp.ChunkSize
+			if last > int64(len(sums.Chunks)) {
+				log.Println("Not enough chunk checksums for", blockID)
+				server.Error("Couldn't read checksum")
+				return
+			}
+			resp.Offset = first * resp.ChunkSize
+			resp.Chunks = sums.Chunks[first:last]
+			end = last * resp.ChunkSize
+			if end > size {
+				end = size
+			}
+		}
+		resp.Length = end - resp.Offset
+		server.Send(&resp)
+		if err := dn.Store.ReadBlockRange(blockID, resp.Offset, resp.Length, c); err != nil {
+			log.Println("Copying error:", err)
 		}
 
 	default:
@@ -177,6 +235,9 @@ func (self *DataNodeState) RPCServer(sock net.Listener) {
 	for {
 		conn, err := sock.Accept()
 		if err != nil {
+			if self.isStopped() {
+				return
+			}
 			log.Fatalln(err)
 		}
 		go RunRPC(conn, self)
@@ -0,0 +1,29 @@
+// Command-line tool to download blobs from cluster.
+package download
+
+import (
+	"context"
+	"io"
+
+	"golang-distributed-filesystem/client"
+)
+
+func Download(blobID string, out io.Writer, debug bool, leaderAddress string, metaDataNodes ...string) error {
+	reader, err := client.New(leaderAddress, debug, metaDataNodes...).Open(context.Background(), blobID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+func DownloadPath(path string, out io.Writer, debug bool, leaderAddress string, metaDataNodes ...string) error {
+	reader, err := client.New(leaderAddress, debug, metaDataNodes...).OpenPath(context.Background(), path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(out, reader)
+	return err
+}
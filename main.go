@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"math/rand"
+	"strings"
 	"time"
 
+	"golang-distributed-filesystem/client"
+	"golang-distributed-filesystem/common"
 	"golang-distributed-filesystem/utils/command"
 
 	"golang-distributed-filesystem/datanode"
+	"golang-distributed-filesystem/download"
 	"golang-distributed-filesystem/metadatanode"
 	"golang-distributed-filesystem/upload"
 )
@@ -25,16 +31,38 @@ func main() {
 	cli.Command("datanode", "Run storage node", func(flag command.Flags) {
 		listener := command.ListenerFlag(flag, "port", 0, "")
 		dataDir := flag.String("dataDir", "_data", "")
-		leaderAddress := flag.String("leaderAddress", "[::1]:5051", "")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5051", "Comma-separated cluster addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		federation := flag.String("federation", "", "Comma-separated cluster addresses of the other federated MetaDataNodes")
+		standbys := flag.String("standbys", "", "Comma-separated cluster addresses of standby MetaDataNodes")
 		heartbeatInterval := flag.Duration("heartbeatInterval", 3*time.Second, "")
+		gossipListener := command.PacketListenerFlag(flag, "gossipPort", 0, "Only used with -gossip")
+		gossipSeeds := flag.String("gossipSeeds", "", "Comma-separated gossip addresses to join through")
+		probeInterval := flag.Duration("probeInterval", time.Second, "")
+		suspicionTimeout := flag.Duration("suspicionTimeout", 5*time.Second, "")
+		var gossip bool
+		flag.BoolVar(&gossip, "gossip", false, "Gossip with the other DataNodes and MetaDataNodes, heartbeating only when needed")
 		flag.Parse()
 
 		conf := datanode.Config{
 			DataDir:           *dataDir,
 			Debug:             debug,
 			Listener:          listener.Get(),
-			HeartbeatInterval: *heartbeatInterval,
-			LeaderAddress:     *leaderAddress}
+			HeartbeatInterval: *heartbeatInterval}
+		conf.LeaderAddress, conf.MetaDataNodes = splitAddresses(*leaderAddress)
+		if *federation != "" {
+			conf.Federation = strings.Split(*federation, ",")
+		}
+		if *standbys != "" {
+			conf.Standbys = strings.Split(*standbys, ",")
+		}
+		if gossip {
+			conf.GossipListener = gossipListener.Get()
+			conf.ProbeInterval = *probeInterval
+			conf.SuspicionTimeout = *suspicionTimeout
+			if *gossipSeeds != "" {
+				conf.GossipSeeds = strings.Split(*gossipSeeds, ",")
+			}
+		}
 		datanode.Create(conf)
 		// Wait on goroutines
 		<-make(chan bool)
@@ -43,27 +71,315 @@ func main() {
 	cli.Command("metadatanode", "Run leader", func(flag command.Flags) {
 		clientListener := command.ListenerFlag(flag, "clientPort", 5050, "")
 		clusterListener := command.ListenerFlag(flag, "clusterPort", 5051, "")
+		raftListener := command.ListenerFlag(flag, "raftPort", 5052, "Only used with -peers")
+		gossipListener := command.PacketListenerFlag(flag, "gossipPort", 5053, "Only used with -gossip")
+		gossipSeeds := flag.String("gossipSeeds", "", "Comma-separated gossip addresses to join through")
+		probeInterval := flag.Duration("probeInterval", time.Second, "")
+		suspicionTimeout := flag.Duration("suspicionTimeout", 5*time.Second, "")
+		dataNodeTimeout := flag.Duration("dataNodeTimeout", 10*time.Second, "How long a DataNode can go unheard from")
+		peers := flag.String("peers", "", "Comma-separated Raft addresses of the other MetaDataNodes")
+		electionTimeout := flag.Duration("electionTimeout", time.Second, "")
+		raftLogEntries := flag.Int("raftLogEntries", 1000, "Applied Raft log entries to keep when compacting, with -peers")
+		host := flag.String("host", "", "How the other MetaDataNodes, DataNodes and clients reach this one")
+		database := flag.String("db", "metadata.db", "")
 		replicationFactor := flag.Int("replicationFactor", 2, "")
+		blockSize := flag.Int64("blockSize", 128*1024*1024, "For blobs that don't ask for one")
+		minBlockSize := flag.Int64("minBlockSize", 1024*1024, "")
+		maxBlockSize := flag.Int64("maxBlockSize", 1024*1024*1024, "")
+		orphanGracePeriod := flag.Duration("orphanGracePeriod", 10*time.Minute, "")
+		leaseDuration := flag.Duration("leaseDuration", 5*time.Minute, "")
+		primary := flag.String("primary", "", "Cluster address of the primary, with -standby")
+		federation := flag.String("federation", "", "Comma-separated client addresses of every federated MetaDataNode, this one included")
+		checkpointEdits := flag.Int("checkpointEdits", 1000, "Edits to log before checkpointing them into the database, without -peers")
+		var upgrade, rollback, standby, gossip bool
+		flag.BoolVar(&gossip, "gossip", false, "Hear from DataNodes through gossip")
+		flag.BoolVar(&standby, "standby", false, "Copy the primary's edits until promoted, instead of serving")
+		flag.BoolVar(&upgrade, "upgrade", false, "Migrate an out of date database, keeping a snapshot to roll back to")
+		flag.BoolVar(&rollback, "rollback", false, "Put back the database from before the last upgrade and exit")
 		flag.Parse()
 
+		if rollback {
+			if err := metadatanode.Rollback(*database); err != nil {
+				log.Fatalln(err)
+			}
+			log.Println("Rolled back", *database)
+			return
+		}
+
+		if standby != (*primary != "") {
+			log.Fatalln("-standby and -primary go together")
+		}
+
 		log.Println("Replication factor of", *replicationFactor)
 		conf := metadatanode.Config{
-			clientListener.Get(),
-			clusterListener.Get(),
-			*replicationFactor,
-			"metadata.db"}
-		metadatanode.Create(conf)
+			ClientListener:    clientListener.Get(),
+			ClusterListener:   clusterListener.Get(),
+			ReplicationFactor: *replicationFactor,
+			DatabaseFile:      *database,
+			Upgrade:           upgrade,
+			Primary:           *primary,
+			CheckpointEdits:   *checkpointEdits,
+			ElectionTimeout:   *electionTimeout,
+			RaftLogEntries:    *raftLogEntries,
+			Host:              *host,
+			BlockSize:         *blockSize,
+			MinBlockSize:      *minBlockSize,
+			MaxBlockSize:      *maxBlockSize,
+			OrphanGracePeriod: *orphanGracePeriod,
+			DataNodeTimeout:   *dataNodeTimeout,
+			LeaseDuration:     *leaseDuration}
+		if *peers != "" {
+			conf.RaftListener = raftListener.Get()
+			conf.Peers = strings.Split(*peers, ",")
+		}
+		if *federation != "" {
+			conf.Federation = strings.Split(*federation, ",")
+		}
+		if gossip {
+			conf.GossipListener = gossipListener.Get()
+			conf.ProbeInterval = *probeInterval
+			conf.SuspicionTimeout = *suspicionTimeout
+			if *gossipSeeds != "" {
+				conf.GossipSeeds = strings.Split(*gossipSeeds, ",")
+			}
+		}
+		if _, err := metadatanode.Create(conf); err != nil {
+			log.Fatalln(err)
+		}
 		// Wait on goroutines
 		<-make(chan bool)
 	})
 
+	cli.Command("metadatanode backup", "Snapshot a running MetaDataNode's database", func(flag command.Flags) {
+		out := command.OutputFileFlag(flag, "out", "- for stdout")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		flag.Parse()
+
+		file := out.Get()
+		defer file.Close()
+		size, err := newClient(*leaderAddress, debug).Backup(context.Background(), file)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Backed up", size, "bytes")
+	})
+
+	cli.Command("metadatanode promote", "Make a standby MetaDataNode take over from its primary", func(flag command.Flags) {
+		address := flag.String("address", "[::1]:5050", "The standby's client address")
+		flag.Parse()
+
+		if err := client.New(*address, debug).Promote(context.Background()); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Promoted", *address)
+	})
+
+	cli.Command("metadatanode restore", "Replace a stopped MetaDataNode's database with a backup, to start it from", func(flag command.Flags) {
+		in := flag.String("in", "", "The backup")
+		database := flag.String("db", "metadata.db", "")
+		flag.Parse()
+
+		if *in == "" {
+			log.Fatalln("-in is needed to restore")
+		}
+		if err := metadatanode.Restore(*in, *database); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Restored", *database, "from", *in)
+	})
+
 	cli.Command("upload", "Upload a file", func(flag command.Flags) {
-		file := command.FileFlag(flag, "file", "")
-		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "")
+		file := command.FileFlag(flag, "file", "- for stdin")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		checksum := flag.String("checksum", common.DefaultChecksum, "crc32, crc32c or sha256")
+		path := flag.String("path", "", "Where to put it in the namespace")
+		resume := flag.String("resume", "", "Blob ID of an interrupted upload of the same file")
+		resumeToken := flag.String("resumeToken", "", "Logged when the interrupted upload started, with -resume")
+		parallel := flag.Int("parallel", 4, "How many blocks to upload at once")
+		blockSize := flag.Int64("blockSize", 0, "0 for the cluster default")
+		replication := flag.Int("replication", 0, "0 for the cluster default")
+		flag.Parse()
+
+		c := newClient(*leaderAddress, debug)
+		c.Checksum = *checksum
+		c.Parallel = *parallel
+		c.BlockSize = *blockSize
+		c.ReplicationFactor = *replication
+		var r *upload.Resume
+		if *resume != "" {
+			r = &upload.Resume{*resume, *resumeToken}
+		}
+		upload.Upload(c, file.Get(), *path, r)
+	})
+
+	cli.Command("download", "Download a blob", func(flag command.Flags) {
+		blobID := flag.String("blob", "", "")
+		path := flag.String("path", "", "Instead of -blob")
+		out := command.OutputFileFlag(flag, "out", "- for stdout")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		flag.Parse()
+
+		if (*blobID == "") == (*path == "") {
+			log.Fatalln("one of these flags must be provided: -blob -path")
+		}
+		file := out.Get()
+		defer file.Close()
+		leader, others := splitAddresses(*leaderAddress)
+		var err error
+		if *path != "" {
+			err = download.DownloadPath(*path, file, debug, leader, others...)
+		} else {
+			err = download.Download(*blobID, file, debug, leader, others...)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	})
+
+	cli.Command("mkdir", "Make a directory and its parents", func(flag command.Flags) {
+		path := flag.String("path", "", "")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		flag.Parse()
+
+		if err := newClient(*leaderAddress, debug).Mkdir(context.Background(), *path); err != nil {
+			log.Fatalln(err)
+		}
+	})
+
+	cli.Command("ls", "List a directory", func(flag command.Flags) {
+		path := flag.String("path", "/", "")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		flag.Parse()
+
+		entries, err := newClient(*leaderAddress, debug).List(context.Background(), *path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, e := range entries {
+			printFileInfo(e)
+		}
+	})
+
+	cli.Command("stat", "Show a file, directory or blob", func(flag command.Flags) {
+		path := flag.String("path", "", "")
+		blobID := flag.String("blob", "", "Instead of -path, show the blob's metadata and blocks")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		flag.Parse()
+
+		if (*blobID == "") == (*path == "") {
+			log.Fatalln("one of these flags must be provided: -blob -path")
+		}
+		c := newClient(*leaderAddress, debug)
+		if *blobID != "" {
+			info, err := c.StatBlob(context.Background(), *blobID)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			printBlobInfo(info)
+			return
+		}
+		info, err := c.Stat(context.Background(), *path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		printFileInfo(info)
+	})
+
+	cli.Command("mv", "Rename a file or directory", func(flag command.Flags) {
+		from := flag.String("from", "", "")
+		to := flag.String("to", "", "")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		flag.Parse()
+
+		if err := newClient(*leaderAddress, debug).Rename(context.Background(), *from, *to); err != nil {
+			log.Fatalln(err)
+		}
+	})
+
+	cli.Command("rm", "Delete a file, directory or blob", func(flag command.Flags) {
+		var recursive bool
+		path := flag.String("path", "", "")
+		blobID := flag.String("blob", "", "Instead of -path")
+		flag.BoolVar(&recursive, "r", false, "Delete directories and their contents")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
 		flag.Parse()
 
-		upload.Upload(file.Get(), debug, *leaderAddress)
+		if (*blobID == "") == (*path == "") {
+			log.Fatalln("one of these flags must be provided: -blob -path")
+		}
+		c := newClient(*leaderAddress, debug)
+		var err error
+		if *blobID != "" {
+			err = c.DeleteBlob(context.Background(), *blobID)
+		} else {
+			err = c.Delete(context.Background(), *path, recursive)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	})
+
+	cli.Command("setrep", "Change the replication factor of a blob", func(flag command.Flags) {
+		path := flag.String("path", "", "")
+		blobID := flag.String("blob", "", "Instead of -path")
+		n := flag.Int("n", 0, "Replication factor")
+		leaderAddress := flag.String("leaderAddress", "[::1]:5050", "Comma-separated client addresses of the MetaDataNodes in a Raft cluster, to ask in turn")
+		flag.Parse()
+
+		if (*blobID == "") == (*path == "") {
+			log.Fatalln("one of these flags must be provided: -blob -path")
+		}
+		c := newClient(*leaderAddress, debug)
+		if *path != "" {
+			info, err := c.Stat(context.Background(), *path)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if info.IsDir {
+				log.Fatalln("Is a directory:", info.Path)
+			}
+			*blobID = info.BlobID
+		}
+		if err := c.SetReplication(context.Background(), *blobID, *n); err != nil {
+			log.Fatalln(err)
+		}
 	})
 
 	cli.Run()
 }
+
+// The first of a comma-separated list of MetaDataNodes, and the rest
+func splitAddresses(list string) (string, []string) {
+	addrs := strings.Split(list, ",")
+	return addrs[0], addrs[1:]
+}
+
+func newClient(leaderAddress string, debug bool) *client.Client {
+	leaderAddress, others := splitAddresses(leaderAddress)
+	return client.New(leaderAddress, debug, others...)
+}
+
+func printFileInfo(info common.FileInfo) {
+	if info.IsDir {
+		fmt.Printf("d %3s %12s %s\n", "-", "-", info.Path)
+	} else {
+		fmt.Printf("- %3d %12d %s  %s\n", info.Replication, info.Size, info.Path, info.BlobID)
+	}
+}
+
+func printBlobInfo(info common.BlobInfo) {
+	fmt.Println("Blob:       ", info.BlobID)
+	fmt.Println("State:      ", info.State)
+	fmt.Println("Size:       ", info.Size)
+	fmt.Println("Block size: ", info.BlockSize)
+	fmt.Println("Replication:", info.Replication)
+	if !info.Created.IsZero() {
+		fmt.Println("Created:    ", info.Created.Format(time.RFC3339))
+	}
+	if !info.Committed.IsZero() {
+		fmt.Println("Committed:  ", info.Committed.Format(time.RFC3339))
+	}
+	for i, b := range info.Blocks {
+		fmt.Printf("%4d %12d %s  %s\n", i, b.Size, b.BlockID, b.Checksum)
+	}
+}
@@ -1,46 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
 	"os"
-	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	. "golang-distributed-filesystem/common"
+	_ "golang-distributed-filesystem/3rdparty/github.com/mattn/go-sqlite3"
+
+	"golang-distributed-filesystem/client"
+	"golang-distributed-filesystem/common"
 	"golang-distributed-filesystem/datanode"
+	"golang-distributed-filesystem/download"
 	"golang-distributed-filesystem/metadatanode"
 	"golang-distributed-filesystem/upload"
 )
 
-type ByRandom []string
-
-func (s ByRandom) Len() int {
-	return len(s)
-}
-func (s ByRandom) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
-func (s ByRandom) Less(i, j int) bool {
-	return rand.Intn(2) == 0 // 0 or 1
-}
-
 // Here's a test. It uploads 18 small blobs onto 2 data nodes, then starts
 // 2 additional datanodes, then downloads the blobs.
 // TODO:
 //   - Decommission nodes
-//   - Check that files are the same
 //   - Random data
 //   - Bigger blobs / more blocks
 func TestIntegration(*testing.T) {
+	for _, dir := range []string{"_data", "_data2", "_data3", "_data4"} {
+		os.RemoveAll(dir)
+	}
 
 	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
 	if err != nil {
@@ -56,6 +54,8 @@ func TestIntegration(*testing.T) {
 		ClusterListener:   mdnClusterListener,
 		ReplicationFactor: 2,
 		DatabaseFile:      "metadata.test.db",
+		LeaseDuration:     2 * time.Second,
+		MinBlockSize:      64,
 	})
 
 	log.Println(mdnClusterListener.Addr().String())
@@ -64,7 +64,7 @@ func TestIntegration(*testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, _ = datanode.Create(datanode.Config{
+	dn1, _ := datanode.Create(datanode.Config{
 		Listener:          dnListener1,
 		LeaderAddress:     mdnClusterListener.Addr().String(),
 		DataDir:           "_data",
@@ -75,86 +75,89 @@ func TestIntegration(*testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, _ = datanode.Create(datanode.Config{
+	dn2, _ := datanode.Create(datanode.Config{
 		Listener:          dnListener2,
 		LeaderAddress:     mdnClusterListener.Addr().String(),
 		DataDir:           "_data2",
 		HeartbeatInterval: 1 * time.Second,
 	})
 
+	waitForRegistration(dn1, dn2)
+
+	original, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	wg := new(sync.WaitGroup)
 	wg2 := new(sync.WaitGroup)
 	doneBalancing := new(sync.WaitGroup)
-	for _, _ = range make([]bool, 18) {
+	checksums := []string{common.CRC32, common.CRC32C, common.SHA256}
+	for i := range make([]bool, 18) {
 		wg.Add(1)
 		wg2.Add(1)
 		doneBalancing.Add(1)
-		go func() {
-			file, err := os.Open("Makefile")
-			if err != nil {
-				panic(err)
+		go func(i int) {
+			var blobID string
+			if i%2 == 0 {
+				file, err := os.Open("Makefile")
+				if err != nil {
+					panic(err)
+				}
+				c := client.New(mdnClientListener.Addr().String(), false)
+				c.Checksum = checksums[i%len(checksums)]
+				blobID = upload.Upload(c, file, "", nil)
+			} else {
+				// A pipe, so the length isn't known
+				r, w := io.Pipe()
+				go func() {
+					w.Write(original)
+					w.Close()
+				}()
+				c := client.New(mdnClientListener.Addr().String(), false)
+				c.Checksum = checksums[i%len(checksums)]
+				c.BlockSize = 64 // Several blocks
+				var err error
+				if blobID, err = c.Upload(context.Background(), r, ""); err != nil {
+					log.Fatalln("Upload error:", err)
+				}
 			}
-			blobID := upload.Upload(file, false, mdnClientListener.Addr().String())
 
 			wg.Done()
 			doneBalancing.Wait()
 
-			conn, err := net.Dial("tcp", mdnClientListener.Addr().String())
+			var downloaded bytes.Buffer
+			if err := download.Download(blobID, &downloaded, false, mdnClientListener.Addr().String()); err != nil {
+				log.Fatalln("Download error:", err)
+			}
+			if !bytes.Equal(downloaded.Bytes(), original) {
+				log.Fatalln("Downloaded blob doesn't match:", blobID)
+			}
+
+			reader, err := client.New(mdnClientListener.Addr().String(), false).Open(context.Background(), blobID)
 			if err != nil {
-				log.Fatal("Dial error:", err)
-			}
-			defer conn.Close()
-			codec := jsonrpc.NewClientCodec(conn)
-			client := rpc.NewClientWithCodec(codec)
-
-			var blocks []BlockID
-			fmt.Println(blobID)
-			if err := client.Call("GetBlob", blobID, &blocks); err != nil {
-				log.Fatal("GetBlob error:", err)
-			}
-			fmt.Println(blocks)
-
-			for _, b := range blocks {
-				for {
-					conn, err := net.Dial("tcp", mdnClientListener.Addr().String())
-					if err != nil {
-						log.Fatal("Dial error:", err)
-					}
-					defer conn.Close()
-					codec := jsonrpc.NewClientCodec(conn)
-					client := rpc.NewClientWithCodec(codec)
-
-					var nodes []string
-					if err := client.Call("GetBlock", b, &nodes); err != nil {
-						log.Fatal("GetBlock error:", err)
-					}
-					fmt.Println(nodes)
-					sort.Sort(ByRandom(nodes))
-
-					conn, err = net.Dial("tcp", nodes[0])
-					if err != nil {
-						log.Fatalln("Dial error:", err)
-					}
-					defer conn.Close()
-					codec = jsonrpc.NewClientCodec(conn)
-					client = rpc.NewClientWithCodec(codec)
-					if err := client.Call("Get", b, nil); err != nil {
-						if fmt.Sprint(err) == "Couldn't get read lock" {
-							time.Sleep(100 * time.Millisecond)
-							continue
-						}
-						log.Fatalln(err)
-					}
-
-					if _, err := io.Copy(ioutil.Discard, conn); err != nil {
-						log.Fatalln(err)
-					}
-					break
-				}
+				log.Fatalln("Open error:", err)
+			}
+			part := make([]byte, 20)
+			if _, err := reader.ReadAt(part, 10); err != nil {
+				log.Fatalln("ReadAt error:", err)
+			}
+			if !bytes.Equal(part, original[10:30]) {
+				log.Fatalln("ReadAt doesn't match:", blobID)
+			}
+			if size, err := reader.Seek(0, io.SeekEnd); err != nil || size != int64(len(original)) {
+				log.Fatalln("Seek error:", size, err)
+			}
+
+			if err := client.New(mdnClientListener.Addr().String(), false).DeleteBlob(context.Background(), blobID); err != nil {
+				log.Fatalln("DeleteBlob error:", err)
+			}
+			if err := download.Download(blobID, ioutil.Discard, false, mdnClientListener.Addr().String()); err == nil {
+				log.Fatalln("Downloaded a deleted blob:", blobID)
 			}
 
 			wg2.Done()
-		}()
+		}(i)
 	}
 
 	wg.Wait()
@@ -162,7 +165,7 @@ func TestIntegration(*testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, _ = datanode.Create(datanode.Config{
+	dn3, _ := datanode.Create(datanode.Config{
 		Listener:          dnListener3,
 		LeaderAddress:     mdnClusterListener.Addr().String(),
 		DataDir:           "_data3",
@@ -172,7 +175,7 @@ func TestIntegration(*testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, _ = datanode.Create(datanode.Config{
+	dn4, _ := datanode.Create(datanode.Config{
 		Listener:          dnListener4,
 		LeaderAddress:     mdnClusterListener.Addr().String(),
 		DataDir:           "_data4",
@@ -183,4 +186,2137 @@ func TestIntegration(*testing.T) {
 		doneBalancing.Done()
 	}
 	wg2.Wait()
+
+	// Deleted blocks should be cleaned up on heartbeats
+	for _, dn := range []*datanode.DataNodeState{dn1, dn2, dn3, dn4} {
+		for i := 0; ; i++ {
+			blocks, err := dn.Store.ReadBlockList()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(blocks) == 0 {
+				break
+			}
+			if i == 200 {
+				log.Fatalln(len(blocks), "deleted blocks left in", dn.Store.DataDir)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+func waitForRegistration(dns ...*datanode.DataNodeState) {
+	for _, dn := range dns {
+		for i := 0; len(dn.NodeID()) == 0; i++ {
+			if i == 200 {
+				log.Fatalln("DataNode at", dn.Addr, "never registered")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// A DataNode dies between uploads while the MetaDataNode still thinks it's
+// alive. The replicas it missed are made up on other DataNodes, without
+// sending the block again to the ones that already have it.
+func TestPipelineFailure(t *testing.T) {
+	removeDatabase("pipeline.test.db")
+	defer removeDatabase("pipeline.test.db")
+
+	clientListener, clusterListener := listen(t), listen(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "pipeline.test.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dns []*datanode.DataNodeState
+	dead := &deadListener{Listener: listen(t)}
+	for i, dir := range []string{"_data_pipeline1", "_data_pipeline2", "_data_pipeline3", "_data_pipeline4"} {
+		os.RemoveAll(dir)
+		var listener net.Listener = dead
+		if i > 0 {
+			listener = listen(t)
+		}
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     clusterListener.Addr().String(),
+			DataDir:           dir,
+			HeartbeatInterval: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	original, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dead DataNode stays the least used, so it's in every pipeline
+	dead.Kill()
+	ctx := context.Background()
+	c := client.New(clientListener.Addr().String(), false)
+	var blobIDs []string
+	for i := 0; i < 4; i++ {
+		w, err := c.Create(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(original); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		blobIDs = append(blobIDs, w.BlobID())
+	}
+
+	// Before anything could have cleaned up extra copies
+	copies := map[common.BlockID]int{}
+	for _, dn := range dns {
+		blocks, err := dn.Store.ReadBlockList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blocks {
+			copies[b]++
+		}
+	}
+	total := 0
+	for _, blobID := range blobIDs {
+		blocks, err := mdn.GetBlobBlocks(blobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blocks {
+			if copies[b.BlockID] != 2 {
+				t.Errorf("Block '%s' has %d copies instead of 2", b.BlockID, copies[b.BlockID])
+			}
+		}
+		total += len(blocks)
+
+		var downloaded bytes.Buffer
+		if err := download.Download(blobID, &downloaded, false, clientListener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(downloaded.Bytes(), original) {
+			t.Error("Downloaded blob doesn't match")
+		}
+	}
+	if len(copies) != total {
+		t.Error(len(copies)-total, "blocks aren't part of a blob")
+	}
+}
+
+// DataNodes a client couldn't reach are left out of new pipelines while
+// they're demoted. When every DataNode in a pipeline is down, the client gets
+// a new one and the upload carries on.
+func TestReplaceTargets(t *testing.T) {
+	removeDatabase("replace.test.db")
+	defer removeDatabase("replace.test.db")
+	dirs := []string{"_data_replace1", "_data_replace2", "_data_replace3", "_data_replace4"}
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	clientListener, clusterListener := listen(t), listen(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "replace.test.db",
+		MinBlockSize:      64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdn.Stop()
+
+	var dns []*datanode.DataNodeState
+	var deads []*deadListener
+	for i, dir := range dirs {
+		var listener net.Listener = listen(t)
+		if i < 2 {
+			dead := &deadListener{Listener: listener}
+			deads = append(deads, dead)
+			listener = dead
+		}
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listener,
+			LeaderAddress:     clusterListener.Addr().String(),
+			DataDir:           dir,
+			HeartbeatInterval: 200 * time.Millisecond,
+			IntegrityInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+	// Still heartbeating, so the MetaDataNode thinks they're fine
+	for _, dead := range deads {
+		dead.Kill()
+	}
+	isDead := map[string]bool{dns[0].Addr: true, dns[1].Addr: true}
+
+	// The live DataNodes are demoted once a client says it can't reach them
+	leader := clientListener.Addr().String()
+	var lease common.Lease
+	if err := leaderCall(leader, "CreateBlob", &common.CreateBlobMsg{"", 64, 4}, &lease); err != nil {
+		t.Fatal(err)
+	}
+	var block common.ForwardBlock
+	if err := leaderCall(leader, "Append", &common.LeaseMsg{lease.BlobID, lease.Token}, &block); err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Nodes) != 4 {
+		t.Fatal("Pipeline", block.Nodes, "doesn't have every DataNode")
+	}
+	excluded := []string{dns[2].Addr, dns[3].Addr}
+	replace := common.ReplaceTargetsMsg{lease.BlobID, lease.Token, block.BlockID, excluded, nil}
+	if err := leaderCall(leader, "ReplaceTargets", &replace, &block); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range block.Nodes {
+		if !isDead[addr] {
+			t.Error("ReplaceTargets didn't exclude", addr)
+		}
+	}
+	if err := leaderCall(leader, "CreateBlob", &common.CreateBlobMsg{"", 64, 2}, &lease); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := leaderCall(leader, "Append", &common.LeaseMsg{lease.BlobID, lease.Token}, &block); err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range block.Nodes {
+			if !isDead[addr] {
+				t.Error("Demoted DataNode", addr, "is in a new pipeline")
+			}
+		}
+	}
+
+	// So every pipeline starts out with only the dead DataNodes
+	original, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c := client.New(leader, false)
+	c.BlockSize = 256
+	blobID, err := c.Upload(ctx, bytes.NewReader(original), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Open(ctx, blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if downloaded, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(downloaded, original) {
+		t.Error("Couldn't download blob", blobID, err)
+	}
+	for _, dn := range dns[:2] {
+		if blocks, _ := dn.Store.ReadBlockList(); len(blocks) != 0 {
+			t.Error("Dead DataNode", dn.Addr, "has blocks", blocks)
+		}
+	}
+}
+
+// Once killed, refuses every connection, as if its DataNode had died
+type deadListener struct {
+	net.Listener
+	dead int32
+}
+
+func (self *deadListener) Kill() {
+	atomic.StoreInt32(&self.dead, 1)
+	self.Listener.Close()
+}
+
+// The DataNode gives up when accepting fails, so a dead one just waits
+func (self *deadListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err != nil && atomic.LoadInt32(&self.dead) == 1 {
+		select {}
+	}
+	return conn, err
+}
+
+// Corrupts one chunk of a replica, which the DataNode finds and throws away.
+// The block is replicated again from the good copy.
+func TestCorruptChunk(t *testing.T) {
+	removeDatabase("corrupt.test.db")
+	defer removeDatabase("corrupt.test.db")
+
+	clientListener, clusterListener := listen(t), listen(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "corrupt.test.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dns []*datanode.DataNodeState
+	for _, dir := range []string{"_data_corrupt1", "_data_corrupt2", "_data_corrupt3"} {
+		os.RemoveAll(dir)
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listen(t),
+			LeaderAddress:     clusterListener.Addr().String(),
+			DataDir:           dir,
+			HeartbeatInterval: 200 * time.Millisecond,
+			// Only checked when the test says so
+			IntegrityInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	original, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One block of several chunks
+	original = bytes.Repeat(original, 1200)
+	ctx := context.Background()
+	c := client.New(clientListener.Addr().String(), false)
+	w, err := c.Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(original); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blobID := w.BlobID()
+	blocks, err := mdn.GetBlobBlocks(blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 {
+		t.Fatal("Expected one block, got", len(blocks))
+	}
+	blockID := blocks[0].BlockID
+	// The DataNodes report the block with their next heartbeats
+	for len(mdn.GetBlock(blockID)) < 2 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var corrupted *datanode.DataNodeState
+	for _, dn := range dns {
+		if _, err := os.Stat(dn.Store.BlockFilename(blockID)); err == nil {
+			corrupted = dn
+			break
+		}
+	}
+	if corrupted == nil {
+		t.Fatal("No DataNode has the block")
+	}
+	file, err := os.OpenFile(corrupted.Store.BlockFilename(blockID), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In the third 64 KB chunk
+	offset := int64(2*64*1024 + 10)
+	if _, err := file.WriteAt([]byte{^original[offset]}, offset); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	errs := corrupted.CheckIntegrity()
+	corrupt, ok := errs[blockID].(*datanode.CorruptBlockError)
+	if len(errs) != 1 || !ok {
+		t.Fatal("Expected the block to be corrupt:", errs)
+	}
+	if len(corrupt.Chunks) != 1 || corrupt.Chunks[0] != 2 {
+		t.Error("Expected chunk 2 to be corrupt, not", corrupt.Chunks)
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(corrupted.Store.BlockFilename(blockID)); os.IsNotExist(err) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Corrupt copy wasn't removed")
+		}
+	}
+	// Replicated from the good copy
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		if time.Since(start) > 20*time.Second {
+			t.Fatal("Block wasn't replicated again:", mdn.GetBlock(blockID))
+		}
+		copies := 0
+		for _, dn := range dns {
+			if _, err := os.Stat(dn.Store.BlockFilename(blockID)); err == nil {
+				copies++
+			}
+		}
+		if copies == 2 && len(mdn.GetBlock(blockID)) == 2 {
+			break
+		}
+	}
+	for _, dn := range dns {
+		if errs := dn.CheckIntegrity(); len(errs) > 0 {
+			t.Error("Still corrupt:", errs)
+		}
+	}
+	var downloaded bytes.Buffer
+	if err := download.Download(blobID, &downloaded, false, clientListener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), original) {
+		t.Error("Downloaded blob doesn't match")
+	}
+}
+
+// Reads ranges of a blob, and past its end, from a block whose checksum was
+// written the way DataNodes did before ranged reads
+func TestRangeRead(t *testing.T) {
+	removeDatabase("range.test.db")
+	defer removeDatabase("range.test.db")
+	os.RemoveAll("_data_range")
+
+	clientListener, clusterListener := listen(t), listen(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "range.test.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dn, err := datanode.Create(datanode.Config{
+		Listener:          listen(t),
+		LeaderAddress:     clusterListener.Addr().String(),
+		DataDir:           "_data_range",
+		HeartbeatInterval: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRegistration(dn)
+
+	// Its own data, so the ranges below stay inside it
+	original := make([]byte, 676)
+	for i := range original {
+		original[i] = byte(i % 251)
+	}
+	ctx := context.Background()
+	c := client.New(clientListener.Addr().String(), false)
+	c.Checksum = common.CRC32
+	w, err := c.Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(original); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The DataNode reports the block with its next heartbeat
+	blocks, err := mdn.GetBlobBlocks(w.BlobID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(mdn.GetBlock(blocks[0].BlockID)) == 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Just the decimal CRC32, as the DataNode used to write it
+	last := blocks[len(blocks)-1].BlockID
+	data, err := ioutil.ReadFile(dn.Store.BlockFilename(last))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := fmt.Sprint(crc32.ChecksumIEEE(data))
+	if err := ioutil.WriteFile(dn.Store.ChecksumFilename(last), []byte(legacy), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := c.Open(ctx, w.BlobID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct{ offset, length int64 }{
+		{0, 10},
+		{250, 20},
+		{300, 256},
+		{600, 76}, // To the end
+		{675, 1},
+	} {
+		part := make([]byte, r.length)
+		if _, err := reader.ReadAt(part, r.offset); err != nil {
+			t.Error("ReadAt", r.offset, "error:", err)
+		} else if !bytes.Equal(part, original[r.offset:r.offset+r.length]) {
+			t.Error("ReadAt", r.offset, "doesn't match")
+		}
+	}
+	if _, err := reader.ReadAt(make([]byte, 10), int64(len(original))); err != io.EOF {
+		t.Error("ReadAt past the end:", err)
+	}
+
+	conn, err := net.Dial("tcp", dn.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataNode := common.NewRPCClient(conn)
+	defer dataNode.Close()
+	var length int64
+	if err := dataNode.Call("GetRange", &common.BlockRange{last, 1000, 1}, &length); err == nil {
+		t.Error("Read a range past the end of the block")
+	}
+}
+
+// Checksums record their algorithm, and old decimal CRC32s still compare
+// equal to the same checksum in the typed form
+func TestChecksums(t *testing.T) {
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	legacy := fmt.Sprint(crc32.ChecksumIEEE(data))
+	typed, err := common.Checksum(common.CRC32, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typed != "crc32:414fa339" {
+		t.Error("Unexpected CRC32:", typed)
+	}
+	if common.NormalizeChecksum(legacy) != typed || !common.ChecksumsEqual(legacy, strings.ToUpper(typed)) {
+		t.Error("Decimal checksum doesn't match the typed one:", legacy, typed)
+	}
+	for sum, algorithm := range map[string]string{
+		legacy:              common.CRC32,
+		typed:               common.CRC32,
+		"crc32c:22620404":   common.CRC32C,
+		"sha256:d7a8fbb307": common.SHA256,
+	} {
+		if got := common.ChecksumAlgorithm(sum); got != algorithm {
+			t.Errorf("Algorithm of %s is %s, not %s", sum, got, algorithm)
+		}
+	}
+	for _, algorithm := range []string{common.CRC32, common.CRC32C, common.SHA256} {
+		sum, err := common.Checksum(algorithm, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := common.VerifyChecksum(sum, data); err != nil {
+			t.Error(algorithm, err)
+		}
+		if err := common.VerifyChecksum(sum, data[1:]); err == nil {
+			t.Error(algorithm, "checksum matches the wrong data")
+		}
+	}
+	if err := common.VerifyChecksum(legacy, data); err != nil {
+		t.Error("Decimal checksum:", err)
+	}
+	if common.ChecksumsEqual("not a checksum", typed) {
+		t.Error("Garbage matches a checksum")
+	}
+	if _, err := common.Checksum("md5", data); err == nil {
+		t.Error("Checksummed with an unknown algorithm")
+	}
+
+	// A block and meta file as the DataNode used to write them
+	os.RemoveAll("_data_checksums")
+	defer os.RemoveAll("_data_checksums")
+	store := datanode.BlockStore{"_data_checksums"}
+	os.MkdirAll(store.BlocksDirectory(), 0777)
+	os.MkdirAll(store.MetaDirectory(), 0777)
+	if err := ioutil.WriteFile(store.BlockFilename("old"), data, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.ChecksumFilename("old"), []byte(legacy), 0777); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.ReadChecksums("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := store.LocalChecksums("old", common.ChecksumAlgorithm(stored.Checksum), stored.ChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ChunkSize != 0 || !common.ChecksumsEqual(stored.Checksum, local.Checksum) {
+		t.Error("Old meta file doesn't match its block:", stored, local)
+	}
+}
+
+// The second DataNode in a pipeline gets the block while the first one is
+// still receiving it
+func TestStreamingPipeline(t *testing.T) {
+	removeDatabase("streaming.test.db")
+	defer removeDatabase("streaming.test.db")
+
+	clusterListener := listen(t)
+	_, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    listen(t),
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "streaming.test.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dns []*datanode.DataNodeState
+	for _, dir := range []string{"_data_streaming1", "_data_streaming2"} {
+		os.RemoveAll(dir)
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listen(t),
+			LeaderAddress:     clusterListener.Addr().String(),
+			DataDir:           dir,
+			HeartbeatInterval: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	data, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Repeat(data, 100)
+	blockID := common.BlockID("streaming")
+	conn, err := net.Dial("tcp", dns[0].Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataNode := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(conn))
+	defer dataNode.Close()
+	forward := common.ForwardBlock{blockID, []string{dns[1].Addr}, int64(len(data)), common.CRC32C}
+	if err := dataNode.Call("Forward", &forward, nil); err != nil {
+		t.Fatal(err)
+	}
+	half := len(data) / 2
+	if _, err := conn.Write(data[:half]); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if info, err := os.Stat(dns[1].Store.BlockFilename(blockID)); err == nil && info.Size() == int64(half) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The next DataNode didn't get any of the block before the first one had all of it")
+		}
+	}
+	if _, err := conn.Write(data[half:]); err != nil {
+		t.Fatal(err)
+	}
+	checksum, _ := common.Checksum(common.CRC32C, data)
+	var replicas []string
+	if err := dataNode.Call("Confirm", checksum, &replicas); err != nil {
+		t.Fatal(err)
+	}
+	if len(replicas) != 1 || replicas[0] != dns[1].Addr {
+		t.Error("Expected the next DataNode to confirm, got", replicas)
+	}
+	for _, dn := range dns {
+		stored, err := ioutil.ReadFile(dn.Store.BlockFilename(blockID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored, data) {
+			t.Error("Block on", dn.Addr, "doesn't match")
+		}
+	}
+}
+
+// The next DataNode in the pipeline takes the start of the block and then
+// stops reading. The first DataNode gives up on it and keeps its own copy.
+func TestHungPipelinePeer(t *testing.T) {
+	os.RemoveAll("_data_hung")
+	defer os.RemoveAll("_data_hung")
+	// Nothing answers there, the DataNode doesn't need a MetaDataNode
+	gone := listen(t)
+	gone.Close()
+	dn, err := datanode.Create(datanode.Config{
+		Listener:          listen(t),
+		LeaderAddress:     gone.Addr().String(),
+		DataDir:           "_data_hung",
+		HeartbeatInterval: time.Second,
+		IntegrityInterval: time.Hour,
+		PipelineTimeout:   200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dn.Stop()
+
+	hung := listen(t)
+	defer hung.Close()
+	go func() {
+		conn, err := hung.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		server := common.NewRPCServer(conn)
+		var forward common.ForwardBlock
+		if _, err := server.ReadHeader(); err != nil {
+			return
+		}
+		if err := server.ReadBody(&forward); err != nil {
+			return
+		}
+		server.SendOkay()
+		// More than the sockets can buffer is sent, and none of it is read
+		select {}
+	}()
+
+	data := bytes.Repeat([]byte("hung"), 8*1024*1024)
+	blockID := common.BlockID("hung")
+	conn, err := net.Dial("tcp", dn.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataNode := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(conn))
+	defer dataNode.Close()
+	forward := common.ForwardBlock{blockID, []string{hung.Addr().String()}, int64(len(data)), common.CRC32C}
+	if err := dataNode.Call("Forward", &forward, nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	var replicas []string
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			done <- err
+			return
+		}
+		checksum, _ := common.Checksum(common.CRC32C, data)
+		done <- dataNode.Call("Confirm", checksum, &replicas)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The hung DataNode held up the block")
+	}
+	if len(replicas) != 0 {
+		t.Error("The hung DataNode confirmed:", replicas)
+	}
+	stored, err := ioutil.ReadFile(dn.Store.BlockFilename(blockID))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Error("The block wasn't kept locally:", err)
+	}
+}
+
+// Uploads blocks four at a time. They're committed in the order they were
+// written, and progress only counts blocks that are acknowledged in order.
+func TestParallelUpload(t *testing.T) {
+	removeDatabase("parallel.test.db")
+	defer removeDatabase("parallel.test.db")
+	dirs := []string{"_data_parallel1", "_data_parallel2"}
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	clientListener, clusterListener := listen(t), listen(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "parallel.test.db",
+		MinBlockSize:      64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdn.Stop()
+	var dns []*datanode.DataNodeState
+	for _, dir := range dirs {
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listen(t),
+			LeaderAddress:     clusterListener.Addr().String(),
+			DataDir:           dir,
+			HeartbeatInterval: 200 * time.Millisecond,
+			IntegrityInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dn.Stop()
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	// Every block is different, and the last one is short
+	var original []byte
+	for i := 0; i < 40; i++ {
+		original = append(original, bytes.Repeat([]byte{byte(i)}, 64)...)
+	}
+	original = append(original, "the end"...)
+
+	var mutex sync.Mutex
+	var progress []int64
+	c := client.New(clientListener.Addr().String(), false)
+	c.BlockSize = 64
+	c.Parallel = 4
+	c.Progress = func(written int64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		progress = append(progress, written)
+	}
+	blobID, err := c.Upload(context.Background(), bytes.NewReader(original), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(progress) == 0 || progress[len(progress)-1] != int64(len(original)) {
+		t.Error("Progress didn't reach", len(original), "->", progress)
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i] <= progress[i-1] {
+			t.Error("Progress went from", progress[i-1], "to", progress[i])
+		}
+	}
+
+	blocks, err := mdn.GetBlobBlocks(blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 41 {
+		t.Fatal("Committed", len(blocks), "blocks instead of 41")
+	}
+	var committed bytes.Buffer
+	for _, b := range blocks {
+		read := false
+		for _, dn := range dns {
+			if _, err := dn.Store.BlockSize(b.BlockID); err == nil {
+				read = dn.Store.ReadBlock(b.BlockID, &committed) == nil
+				break
+			}
+		}
+		if !read {
+			t.Fatal("Couldn't read block", b.BlockID)
+		}
+	}
+	if !bytes.Equal(committed.Bytes(), original) {
+		t.Error("Blocks weren't committed in the order they were written")
+	}
+}
+
+// Builds a small tree of empty blobs, which don't need any DataNodes.
+func TestNamespace(t *testing.T) {
+	removeDatabase("namespace.test.db")
+	defer removeDatabase("namespace.test.db")
+
+	// Every CreateBlob would fail with a default outside the bounds
+	_, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    listen(t),
+		ClusterListener:   listen(t),
+		ReplicationFactor: 2,
+		DatabaseFile:      "namespace.test.db",
+		BlockSize:         512,
+	})
+	if err == nil {
+		t.Error("Started with a default block size below the minimum")
+	}
+
+	mdnClientListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mdnClusterListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = metadatanode.Create(metadatanode.Config{
+		ClientListener:    mdnClientListener,
+		ClusterListener:   mdnClusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "namespace.test.db",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	c := client.New(mdnClientListener.Addr().String(), false)
+	if err := c.Mkdir(ctx, "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a/b/one", "/a/b/two", "/a/three"} {
+		w, err := c.CreateAt(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.CreateAt(ctx, "/missing/four"); err == nil {
+		t.Error("Created a file in a missing directory")
+	}
+	if _, err := c.CreateAt(ctx, "/a/three"); err == nil {
+		t.Error("Created a file twice")
+	}
+
+	if info, err := c.Stat(ctx, "/a/three"); err != nil || info.BlockSize != 128*1024*1024 {
+		t.Error("Wrong default block size:", info.BlockSize, err)
+	}
+	c.BlockSize = 1
+	if _, err := c.CreateAt(ctx, "/a/tiny"); err == nil {
+		t.Error("Created a blob with a block size under the minimum")
+	}
+	c.BlockSize = 0
+
+	if err := c.Rename(ctx, "/a/b", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := c.List(ctx, "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Path != "/c/one" || entries[1].Path != "/c/two" {
+		t.Error("Wrong listing after rename:", entries)
+	}
+	if _, err := c.Stat(ctx, "/a/b/one"); err == nil {
+		t.Error("Old path still exists after rename")
+	}
+
+	if err := c.Delete(ctx, "/c", false); err == nil {
+		t.Error("Deleted a non-empty directory without -r")
+	}
+	// Errors that only mention a redirect aren't one
+	if _, err := c.Stat(ctx, "/Not the leader"); err == nil {
+		t.Error("Stat of a missing path succeeded")
+	} else if _, ok := common.LeaderRedirect(err); ok {
+		t.Error("Took a missing path error for a redirect:", err)
+	}
+	// A retried Commit succeeds as long as the blocks are the same
+	var lease common.Lease
+	if err := leaderCall(mdnClientListener.Addr().String(), "CreateBlob", &common.CreateBlobMsg{Path: "/a/retried"}, &lease); err != nil {
+		t.Fatal(err)
+	}
+	commit := common.CommitMsg{lease.BlobID, lease.Token, nil}
+	for i := 0; i < 2; i++ {
+		if err := leaderCall(mdnClientListener.Addr().String(), "Commit", &commit, nil); err != nil {
+			t.Fatal("Commit", i, "failed:", err)
+		}
+	}
+	commit.Blocks = []common.BlockInfo{{"other:block", 1, ""}}
+	if err := leaderCall(mdnClientListener.Addr().String(), "Commit", &commit, nil); err == nil {
+		t.Error("Committed a blob again with different blocks")
+	}
+
+	// So is a retried AckBlock, which doesn't count the block twice
+	if err := leaderCall(mdnClientListener.Addr().String(), "CreateBlob", &common.CreateBlobMsg{}, &lease); err != nil {
+		t.Fatal(err)
+	}
+	var block common.ForwardBlock
+	if err := leaderCall(mdnClientListener.Addr().String(), "Append", &common.LeaseMsg{lease.BlobID, lease.Token}, &block); err != nil {
+		t.Fatal(err)
+	}
+	ack := common.AckBlockMsg{lease.BlobID, lease.Token, common.BlockInfo{block.BlockID, 10, ""}, nil}
+	for i := 0; i < 2; i++ {
+		if err := leaderCall(mdnClientListener.Addr().String(), "AckBlock", &ack, nil); err != nil {
+			t.Fatal("AckBlock", i, "failed:", err)
+		}
+	}
+	ack.Block.Size = 20
+	if err := leaderCall(mdnClientListener.Addr().String(), "AckBlock", &ack, nil); err == nil {
+		t.Error("Acked a block again with a different size")
+	}
+	var resume common.ResumeResponse
+	if err := leaderCall(mdnClientListener.Addr().String(), "ResumeBlob", &common.ResumeMsg{lease.BlobID, lease.Token}, &resume); err == nil {
+		t.Error("Resumed a blob with its lease token instead of its resume token")
+	}
+	if err := leaderCall(mdnClientListener.Addr().String(), "ResumeBlob", &common.ResumeMsg{lease.BlobID, lease.ResumeToken}, &resume); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaderCall(mdnClientListener.Addr().String(), "Append", &common.LeaseMsg{lease.BlobID, lease.Token}, &block); err == nil {
+		t.Error("Appended with the lease from before the blob was resumed")
+	}
+	if len(resume.Blocks) != 1 {
+		t.Error("Wrong blocks to resume from after a retried AckBlock:", resume.Blocks)
+	}
+
+	one, err := c.Stat(ctx, "/c/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "/c", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteBlob(ctx, one.BlobID); err == nil {
+		t.Error("Blob still exists after deleting its directory")
+	}
+	entries, err = c.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != "/a" || !entries[0].IsDir {
+		t.Error("Wrong listing after delete:", entries)
+	}
+}
+
+// A MetaDataNode started from a backup serves the blobs committed before it
+// was taken. Blocks written since are orphans, and are swept from the
+// DataNodes.
+func TestRestore(t *testing.T) {
+	for _, db := range []string{"original.test.db", "restored.test.db", "restored.test.db.before-restore"} {
+		removeDatabase(db)
+		defer removeDatabase(db)
+	}
+	defer os.Remove("backup.test.db")
+	dirs := []string{"_data_restore1", "_data_restore2"}
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	start := func(db string) (*metadatanode.MetaDataNodeState, []*datanode.DataNodeState, string) {
+		clientListener, clusterListener := listen(t), listen(t)
+		mdn, err := metadatanode.Create(metadatanode.Config{
+			ClientListener:    clientListener,
+			ClusterListener:   clusterListener,
+			ReplicationFactor: 2,
+			DatabaseFile:      db,
+			MinBlockSize:      64,
+			OrphanGracePeriod: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dns []*datanode.DataNodeState
+		for _, dir := range dirs {
+			dn, err := datanode.Create(datanode.Config{
+				Listener:          listen(t),
+				LeaderAddress:     clusterListener.Addr().String(),
+				DataDir:           dir,
+				HeartbeatInterval: 200 * time.Millisecond,
+				IntegrityInterval: time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dns = append(dns, dn)
+		}
+		waitForRegistration(dns...)
+		return mdn, dns, clientListener.Addr().String()
+	}
+	stop := func(mdn *metadatanode.MetaDataNodeState, dns []*datanode.DataNodeState) {
+		mdn.Stop()
+		for _, dn := range dns {
+			dn.Stop()
+		}
+	}
+
+	ctx := context.Background()
+	mdn, dns, addr := start("original.test.db")
+	c := client.New(addr, false)
+	c.BlockSize = 64
+	before := bytes.Repeat([]byte("before the backup "), 10)
+	beforeID, err := c.Upload(ctx, bytes.NewReader(before), "/before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if _, err := c.Backup(ctx, &backup); err != nil {
+		t.Fatal(err)
+	}
+	afterID, err := c.Upload(ctx, bytes.NewReader(bytes.Repeat([]byte("after the backup "), 10)), "/after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterBlocks, err := mdn.GetBlobBlocks(afterID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop(mdn, dns)
+
+	if err := ioutil.WriteFile("backup.test.db", backup.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := metadatanode.Restore("backup.test.db", "restored.test.db"); err != nil {
+		t.Fatal(err)
+	}
+	mdn, dns, addr = start("restored.test.db")
+	defer stop(mdn, dns)
+	c = client.New(addr, false)
+
+	var downloaded bytes.Buffer
+	if err := download.Download(beforeID, &downloaded, false, addr); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), before) {
+		t.Error("Downloaded the blob from before the backup wrong")
+	}
+	if _, err := c.Stat(ctx, "/after"); err == nil {
+		t.Error("The restored namespace has a file from after the backup")
+	}
+
+	swept := func() bool {
+		for _, dn := range dns {
+			for _, b := range afterBlocks {
+				if _, err := dn.Store.BlockSize(b.BlockID); err == nil {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for deadline := time.Now().Add(10 * time.Second); !swept(); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Blocks from after the backup weren't swept as orphans")
+		}
+	}
+	downloaded.Reset()
+	if err := download.Download(beforeID, &downloaded, false, addr); err != nil || !bytes.Equal(downloaded.Bytes(), before) {
+		t.Error("Lost the blob from before the backup with the orphans:", err)
+	}
+}
+
+// Edits a database loses in a crash come back from the edit log
+func TestEditLog(t *testing.T) {
+	for _, db := range []string{"editlog.test.db", "crashed.test.db"} {
+		removeDatabase(db)
+		defer removeDatabase(db)
+	}
+	start := func(db string) (*metadatanode.MetaDataNodeState, *client.Client) {
+		clientListener := listen(t)
+		mdn, err := metadatanode.Create(metadatanode.Config{
+			ClientListener:    clientListener,
+			ClusterListener:   listen(t),
+			ReplicationFactor: 2,
+			DatabaseFile:      db,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mdn, client.New(clientListener.Addr().String(), false)
+	}
+
+	ctx := context.Background()
+	mdn, c := start("editlog.test.db")
+	if err := c.Mkdir(ctx, "/before"); err != nil {
+		t.Fatal(err)
+	}
+	// What the database file could look like after a crash, without the
+	// edits since
+	var image bytes.Buffer
+	if _, err := c.Backup(ctx, &image); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mkdir(ctx, "/after"); err != nil {
+		t.Fatal(err)
+	}
+	mdn.Stop()
+
+	if err := ioutil.WriteFile("crashed.test.db", image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	edits, err := ioutil.ReadFile("editlog.test.db.edits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Plus half of an edit that was never acknowledged
+	edits = append(edits, `{"Index":4,"Edit":{"Op":"Mk`...)
+	if err := ioutil.WriteFile("crashed.test.db.edits", edits, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mdn, c = start("crashed.test.db")
+	defer mdn.Stop()
+	for _, p := range []string{"/before", "/after"} {
+		if info, err := c.Stat(ctx, p); err != nil || !info.IsDir {
+			t.Error("Missing", p, "after replaying the edit log:", err)
+		}
+	}
+	if err := c.Mkdir(ctx, "/later"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A block is sent and then the lease expires without the blob being
+// committed. The blob is abandoned and the block is deleted from the
+// DataNode.
+func TestAbandonUpload(t *testing.T) {
+	removeDatabase("abandon.test.db")
+	defer removeDatabase("abandon.test.db")
+	os.RemoveAll("_data_abandon")
+	defer os.RemoveAll("_data_abandon")
+
+	clientListener, clusterListener := listen(t), listen(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "abandon.test.db",
+		OrphanGracePeriod: time.Second,
+		LeaseDuration:     time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdn.Stop()
+	dn, err := datanode.Create(datanode.Config{
+		Listener:          listen(t),
+		LeaderAddress:     clusterListener.Addr().String(),
+		DataDir:           "_data_abandon",
+		HeartbeatInterval: 200 * time.Millisecond,
+		IntegrityInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dn.Stop()
+	waitForRegistration(dn)
+
+	leaderAddress := clientListener.Addr().String()
+	var lease common.Lease
+	if err := leaderCall(leaderAddress, "CreateBlob", &common.CreateBlobMsg{}, &lease); err != nil {
+		t.Fatal(err)
+	}
+	var block common.ForwardBlock
+	if err := leaderCall(leaderAddress, "Append", &common.LeaseMsg{lease.BlobID, lease.Token}, &block); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("abandoned")
+	conn, err := net.Dial("tcp", block.Nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataNode := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(conn))
+	defer dataNode.Close()
+	forward := common.ForwardBlock{block.BlockID, nil, int64(len(data)), common.CRC32C}
+	if err := dataNode.Call("Forward", &forward, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	checksum, _ := common.Checksum(common.CRC32C, data)
+	if err := dataNode.Call("Confirm", checksum, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The block was never acked, so no DataNodes are known to have it
+	commit := common.CommitMsg{lease.BlobID, lease.Token, []common.BlockInfo{{block.BlockID, int64(len(data)), checksum}}}
+	if err := leaderCall(leaderAddress, "Commit", &commit, nil); err == nil {
+		t.Fatal("Committed a block without its replicas")
+	}
+
+	for i := 0; ; i++ {
+		if _, err := dn.Store.BlockSize(block.BlockID); err != nil {
+			break
+		}
+		if i == 200 {
+			t.Fatal("The abandoned block wasn't swept up")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := client.New(leaderAddress, false).StatBlob(context.Background(), lease.BlobID); err == nil {
+		t.Error("The abandoned blob is still there")
+	}
+}
+
+// An upload is dropped and picked up again with its resume token, carrying on
+// from the blocks that were acknowledged
+func TestResumeUpload(t *testing.T) {
+	removeDatabase("resume.test.db")
+	defer removeDatabase("resume.test.db")
+	os.RemoveAll("_data_resume")
+	defer os.RemoveAll("_data_resume")
+
+	clientListener, clusterListener := listen(t), listen(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 1,
+		DatabaseFile:      "resume.test.db",
+		MinBlockSize:      64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdn.Stop()
+	dn, err := datanode.Create(datanode.Config{
+		Listener:          listen(t),
+		LeaderAddress:     clusterListener.Addr().String(),
+		DataDir:           "_data_resume",
+		HeartbeatInterval: 200 * time.Millisecond,
+		IntegrityInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dn.Stop()
+	waitForRegistration(dn)
+
+	data := bytes.Repeat([]byte("resumed "), 100)
+	leaderAddress := clientListener.Addr().String()
+	c := client.New(leaderAddress, false)
+	c.BlockSize = 64
+	acked := make(chan int64, 1)
+	c.Progress = func(written int64) { acked <- written }
+	ctx, cancel := context.WithCancel(context.Background())
+	writer, err := c.Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One whole block and the start of the next, dropped once the whole one
+	// is acknowledged
+	writer.Write(data[:100])
+	<-acked
+	cancel()
+	c.Progress = nil
+
+	if _, _, err := c.Resume(context.Background(), writer.BlobID(), "wrong"); err == nil {
+		t.Fatal("Resumed without the resume token")
+	}
+	writer, offset, err := c.Resume(context.Background(), writer.BlobID(), writer.ResumeToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 64 {
+		t.Error("Resumed from", offset, "instead of after the first block")
+	}
+	if _, err := writer.Write(data[offset:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blobID := writer.BlobID()
+
+	// Replicas are known as soon as the upload's committed
+	var downloaded bytes.Buffer
+	if err := download.Download(blobID, &downloaded, false, leaderAddress); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), data) {
+		t.Error("Resumed blob doesn't match")
+	}
+	info, err := c.StatBlob(context.Background(), blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State != "committed" || info.Size != int64(len(data)) || info.Committed.Before(info.Created) {
+		t.Error("Wrong blob metadata:", info)
+	}
+	for _, b := range info.Blocks {
+		if b.Checksum == "" {
+			t.Error("No checksum recorded for block", b.BlockID)
+		}
+	}
+}
+
+// A blob uploaded with one replica gets two more when it asks for three,
+// more than the cluster's default
+func TestSetReplication(t *testing.T) {
+	removeDatabase("setrep.test.db")
+	defer removeDatabase("setrep.test.db")
+	dirs := []string{"_data_setrep1", "_data_setrep2", "_data_setrep3"}
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	clientListener, clusterListener := listen(t), listen(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "setrep.test.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdn.Stop()
+	var dns []*datanode.DataNodeState
+	for _, dir := range dirs {
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listen(t),
+			LeaderAddress:     clusterListener.Addr().String(),
+			DataDir:           dir,
+			HeartbeatInterval: 200 * time.Millisecond,
+			IntegrityInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dn.Stop()
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	leaderAddress := clientListener.Addr().String()
+	c := client.New(leaderAddress, false)
+	c.ReplicationFactor = 1
+	blobID, err := c.Upload(context.Background(), strings.NewReader("replicated"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForReplicas(leaderAddress, blobID, 1)
+	if err := c.SetReplication(context.Background(), blobID, 3); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplicas(leaderAddress, blobID, 3)
+	if info, err := c.StatBlob(context.Background(), blobID); err != nil || info.Replication != 3 {
+		t.Error("Wrong replication factor:", info.Replication, err)
+	}
+}
+
+// A database from before versioning needs -upgrade, and can be rolled back
+// along with the edits it hadn't checkpointed
+func TestUpgrade(t *testing.T) {
+	for _, db := range []string{"upgrade.test.db", "upgrade.test.db.rollback"} {
+		removeDatabase(db)
+		defer removeDatabase(db)
+	}
+
+	conn, err := sql.Open("sqlite3", "upgrade.test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE file_blocks(blob, block)",
+		"INSERT INTO file_blocks VALUES('a', 'a:1')",
+		"INSERT INTO file_blocks VALUES('a', 'a:2')",
+	} {
+		if _, err := conn.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	edits := []byte(`{"Index":1,"Edit":{"Op":"Mkdir","Path":"/logged"}}` + "\n")
+	if err := ioutil.WriteFile("upgrade.test.db.edits", edits, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := metadatanode.OpenDB("upgrade.test.db", false); err == nil {
+		t.Fatal("Opened an out of date database without upgrading")
+	}
+	db, err := metadatanode.OpenDB("upgrade.test.db", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := db.Get("a")
+	if err != nil || len(blocks) != 2 || blocks[0] != "a:1" || blocks[1] != "a:2" {
+		t.Error("Wrong blocks after upgrade:", blocks, err)
+	}
+	db.Close()
+
+	// Starting checkpoints the edit log into the upgraded database
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    listen(t),
+		ClusterListener:   listen(t),
+		ReplicationFactor: 2,
+		DatabaseFile:      "upgrade.test.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdn.Stop()
+	if !hasFile("upgrade.test.db", "/logged") {
+		t.Error("The edit log wasn't replayed after the upgrade")
+	}
+
+	if err := metadatanode.Rollback("upgrade.test.db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := metadatanode.OpenDB("upgrade.test.db", false); err == nil {
+		t.Error("Rolled back database isn't out of date")
+	}
+	if rolledBack, err := ioutil.ReadFile("upgrade.test.db.edits"); err != nil || !bytes.Equal(rolledBack, edits) {
+		t.Error("Lost the edits that weren't checkpointed before the upgrade:", string(rolledBack), err)
+	}
+}
+
+func waitForReplicas(leaderAddress string, blobID string, n int) {
+	var blocks []common.BlockID
+	if err := leaderCall(leaderAddress, "GetBlob", blobID, &blocks); err != nil {
+		log.Fatalln("GetBlob error:", err)
+	}
+	for _, b := range blocks {
+		for i := 0; ; i++ {
+			var nodes []string
+			leaderCall(leaderAddress, "GetBlock", b, &nodes)
+			if len(nodes) == n {
+				break
+			}
+			if i == 200 {
+				log.Fatalln("Block", b, "has", len(nodes), "replicas, not", n)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// The MetaDataNode answers one call per connection
+func leaderCall(leaderAddress string, method string, args interface{}, reply interface{}) error {
+	conn, err := net.Dial("tcp", leaderAddress)
+	if err != nil {
+		return err
+	}
+	leader := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(conn))
+	defer leader.Close()
+	return leader.Call(method, args, reply)
+}
+
+// Three MetaDataNodes replicate through Raft. Clients and DataNodes given all
+// of them keep working after the one they started at, the leader, goes away.
+func TestRaft(t *testing.T) {
+	dbs := []string{"raft0.test.db", "raft1.test.db", "raft2.test.db"}
+	for _, db := range dbs {
+		os.Remove(db)
+		defer os.Remove(db)
+	}
+	for _, dir := range []string{"_data_raft", "_data_raft2"} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	var raftListeners, clientListeners, clusterListeners []net.Listener
+	for range dbs {
+		raftListeners = append(raftListeners, listen(t))
+		clientListeners = append(clientListeners, listen(t))
+		clusterListeners = append(clusterListeners, listen(t))
+	}
+	start := func(i int) *metadatanode.MetaDataNodeState {
+		var peers []string
+		for j, l := range raftListeners {
+			if j != i {
+				peers = append(peers, l.Addr().String())
+			}
+		}
+		mdn, err := metadatanode.Create(metadatanode.Config{
+			ClientListener:    clientListeners[i],
+			ClusterListener:   clusterListeners[i],
+			RaftListener:      raftListeners[i],
+			Peers:             peers,
+			ElectionTimeout:   300 * time.Millisecond,
+			RaftLogEntries:    2,
+			ReplicationFactor: 2,
+			DatabaseFile:      dbs[i],
+			MinBlockSize:      64,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mdn
+	}
+	var mdns []*metadatanode.MetaDataNodeState
+	for i := range dbs {
+		mdn := start(i)
+		defer mdn.Stop()
+		mdns = append(mdns, mdn)
+	}
+
+	// Clients and DataNodes are given the leader first, so they have to try
+	// the others once it's stopped
+	leader := waitForLeader(t, mdns)
+	var clientAddrs, clusterAddrs []string
+	for i, mdn := range mdns {
+		if mdn == leader {
+			clientAddrs = append([]string{clientListeners[i].Addr().String()}, clientAddrs...)
+			clusterAddrs = append([]string{clusterListeners[i].Addr().String()}, clusterAddrs...)
+		} else {
+			clientAddrs = append(clientAddrs, clientListeners[i].Addr().String())
+			clusterAddrs = append(clusterAddrs, clusterListeners[i].Addr().String())
+		}
+	}
+
+	var dns []*datanode.DataNodeState
+	for _, dir := range []string{"_data_raft", "_data_raft2"} {
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listen(t),
+			LeaderAddress:     clusterAddrs[0],
+			MetaDataNodes:     clusterAddrs[1:],
+			DataDir:           dir,
+			HeartbeatInterval: 200 * time.Millisecond,
+			// Outlives the test, which removes its DataDir
+			IntegrityInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	original, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c := client.New(clientAddrs[0], false, clientAddrs[1:]...)
+	c.BlockSize = 256
+	if err := c.Mkdir(ctx, "/raft"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Upload(ctx, bytes.NewReader(original), "/raft/Makefile"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every node ends up with the file
+	for _, db := range dbs {
+		for i := 0; !hasFile(db, "/raft/Makefile"); i++ {
+			if i == 50 {
+				t.Fatal("/raft/Makefile didn't replicate to", db)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	leader.Stop()
+	newLeader := waitForLeader(t, mdns)
+	if newLeader == leader {
+		t.Fatal("Stopped leader is still leading")
+	}
+	if err := c.Mkdir(ctx, "/raft/after"); err != nil {
+		t.Fatal(err)
+	}
+	// The DataNodes have to register with the new leader before it knows
+	// where the blocks are
+	for i := 0; ; i++ {
+		downloaded, err := readPath(ctx, c, "/raft/Makefile")
+		if err == nil && bytes.Equal(downloaded, original) {
+			break
+		}
+		if i == 50 {
+			t.Fatal("Couldn't download after failover:", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The old leader comes back after the others have compacted away the
+	// entries it's missing, so it needs a snapshot
+	for i := 0; i < 10; i++ {
+		if err := c.Mkdir(ctx, fmt.Sprintf("/raft/after/%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := 0
+	for mdns[old] != leader {
+		old++
+	}
+	oldLast := lastRaftIndex(t, dbs[old])
+	newLeaderDB := dbs[0]
+	for i, mdn := range mdns {
+		if mdn == newLeader {
+			newLeaderDB = dbs[i]
+		}
+	}
+	if compacted := raftSnapshotIndex(t, newLeaderDB); compacted <= oldLast {
+		t.Fatal("The log was compacted up to", compacted, "but the old leader has up to", oldLast)
+	}
+	for _, l := range []*net.Listener{&raftListeners[old], &clientListeners[old], &clusterListeners[old]} {
+		var err error
+		if *l, err = net.Listen("tcp", (*l).Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restarted := start(old)
+	defer restarted.Stop()
+	for i := 0; !hasFile(dbs[old], "/raft/after/9"); i++ {
+		if i == 50 {
+			t.Fatal("The old leader didn't catch up")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// A standby copies the primary's edits and hears from the DataNodes, so once
+// it's promoted it can serve without waiting for them to register.
+func TestStandby(t *testing.T) {
+	for _, db := range []string{"primary.test.db", "standby.test.db"} {
+		removeDatabase(db)
+		defer removeDatabase(db)
+	}
+	for _, dir := range []string{"_data_standby1", "_data_standby2"} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	primaryCluster := listen(t)
+	primary, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    listen(t),
+		ClusterListener:   primaryCluster,
+		ReplicationFactor: 2,
+		DatabaseFile:      "primary.test.db",
+		CheckpointEdits:   2,
+		MinBlockSize:      64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Stop()
+	standbyClient, standbyCluster := listen(t), listen(t)
+	standby, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    standbyClient,
+		ClusterListener:   standbyCluster,
+		Primary:           primaryCluster.Addr().String(),
+		ReplicationFactor: 2,
+		DatabaseFile:      "standby.test.db",
+		MinBlockSize:      64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Stop()
+	if standby.IsLeader() {
+		t.Fatal("Standby is serving before it's promoted")
+	}
+
+	var dns []*datanode.DataNodeState
+	for _, dir := range []string{"_data_standby1", "_data_standby2"} {
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listen(t),
+			LeaderAddress:     primaryCluster.Addr().String(),
+			Standbys:          []string{standbyCluster.Addr().String()},
+			DataDir:           dir,
+			HeartbeatInterval: 200 * time.Millisecond,
+			// Outlives the test, which removes its DataDir
+			IntegrityInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	original, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The standby sends clients to the primary until it's promoted
+	ctx := context.Background()
+	c := client.New(standbyClient.Addr().String(), false)
+	c.BlockSize = 256
+	for i := 0; ; i++ {
+		err := c.Mkdir(ctx, "/standby")
+		if err == nil {
+			break
+		}
+		// Until the standby has heard from the primary where to send clients
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := c.Upload(ctx, bytes.NewReader(original), "/standby/Makefile"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !hasFile("standby.test.db", "/standby/Makefile"); i++ {
+		if i == 50 {
+			t.Fatal("/standby/Makefile didn't reach the standby")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	primary.Stop()
+	p := client.New(standbyClient.Addr().String(), false)
+	if err := p.Promote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Promote(ctx); err == nil {
+		t.Error("Promoted a MetaDataNode twice")
+	}
+	if !standby.IsLeader() {
+		t.Fatal("Promoted standby isn't serving")
+	}
+	c = client.New(standbyClient.Addr().String(), false)
+	// Only needs the DataNodes' next heartbeats for the blocks they had
+	// just written when the primary stopped
+	for i := 0; ; i++ {
+		downloaded, err := readPath(ctx, c, "/standby/Makefile")
+		if err == nil && bytes.Equal(downloaded, original) {
+			break
+		}
+		if i == 50 {
+			t.Fatal("Couldn't download after promotion:", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := c.Mkdir(ctx, "/standby/after"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Two federated MetaDataNodes split the namespace and blobs between them,
+// sharing the DataNodes. The client only needs to know one of them.
+func TestFederation(t *testing.T) {
+	dbs := []string{"federation0.test.db", "federation1.test.db"}
+	for _, db := range dbs {
+		removeDatabase(db)
+		defer removeDatabase(db)
+	}
+	for _, dir := range []string{"_data_federation1", "_data_federation2"} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	var clientListeners, clusterListeners []net.Listener
+	var members []string
+	for range dbs {
+		clientListeners = append(clientListeners, listen(t))
+		clusterListeners = append(clusterListeners, listen(t))
+		members = append(members, clientListeners[len(clientListeners)-1].Addr().String())
+	}
+	for i, db := range dbs {
+		mdn, err := metadatanode.Create(metadatanode.Config{
+			ClientListener:    clientListeners[i],
+			ClusterListener:   clusterListeners[i],
+			Federation:        members,
+			ReplicationFactor: 2,
+			DatabaseFile:      db,
+			MinBlockSize:      64,
+			OrphanGracePeriod: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mdn.Stop()
+	}
+
+	var dns []*datanode.DataNodeState
+	for _, dir := range []string{"_data_federation1", "_data_federation2"} {
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listen(t),
+			LeaderAddress:     clusterListeners[0].Addr().String(),
+			Federation:        []string{clusterListeners[1].Addr().String()},
+			DataDir:           dir,
+			HeartbeatInterval: 200 * time.Millisecond,
+			// Outlives the test, which removes its DataDir
+			IntegrityInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	// Enough top-level directories that each MetaDataNode has one
+	ring := common.NewHashRing(members)
+	var dirs []string
+	owned := map[string]bool{}
+	for i := 0; len(owned) < len(members); i++ {
+		dir := fmt.Sprintf("/fed%d", i)
+		dirs = append(dirs, dir)
+		owned[ring.Owner(common.PathKey(dir))] = true
+	}
+
+	original, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c := client.New(members[0], false)
+	c.BlockSize = 256
+	for _, dir := range dirs {
+		if err := c.Mkdir(ctx, dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Upload(ctx, bytes.NewReader(original), dir+"/Makefile"); err != nil {
+			t.Fatal(err)
+		}
+		for i, db := range dbs {
+			if hasFile(db, dir+"/Makefile") != (members[i] == ring.Owner(common.PathKey(dir))) {
+				t.Error(dir+"/Makefile", "isn't only on the MetaDataNode in charge of it")
+			}
+		}
+	}
+	// Without a path, the blob belongs to the MetaDataNode the client knows
+	blobID, err := c.Upload(ctx, bytes.NewReader(original), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := ring.Owner(common.BlobKey(blobID)); owner != members[0] {
+		t.Error("Blob", blobID, "belongs to", owner, "not", members[0])
+	}
+
+	entries, err := c.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(dirs) {
+		t.Error("Listed", entries, "not", dirs)
+	}
+	for i := 1; i < len(dirs); i++ {
+		if ring.Owner(common.PathKey(dirs[0])) != ring.Owner(common.PathKey(dirs[i])) {
+			if err := c.Rename(ctx, dirs[i]+"/Makefile", dirs[0]+"/Makefile2"); err == nil {
+				t.Error("Moved", dirs[i]+"/Makefile", "to another MetaDataNode")
+			}
+			break
+		}
+	}
+
+	// Past the grace period, neither MetaDataNode takes the other's blocks
+	// for orphans
+	time.Sleep(4 * time.Second)
+	for _, dir := range dirs {
+		downloaded, err := readPath(ctx, c, dir+"/Makefile")
+		if err != nil || !bytes.Equal(downloaded, original) {
+			t.Error("Couldn't download", dir+"/Makefile:", err)
+		}
+	}
+	r, err := c.Open(ctx, blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if downloaded, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(downloaded, original) {
+		t.Error("Couldn't download blob", blobID, err)
+	}
+}
+
+// DataNodes and the MetaDataNode gossip over UDP. Members hear about each
+// other's changes, and a DataNode that dies is forgotten and its blocks
+// replicated long before it would have gone unheard from for too long.
+func TestGossip(t *testing.T) {
+	var members []*common.Gossip
+	for i := 0; i < 3; i++ {
+		conf := common.GossipConfig{
+			Conn:             listenPacket(t),
+			ProbeInterval:    50 * time.Millisecond,
+			SuspicionTimeout: 250 * time.Millisecond,
+			Meta:             common.GossipMeta{SpaceUsed: i},
+		}
+		if i > 0 {
+			conf.Seeds = []string{members[0].Addr()}
+		}
+		members = append(members, common.NewGossip(conf))
+	}
+	defer members[1].Stop()
+	defer members[2].Stop()
+	members[0].SetMeta(common.GossipMeta{SpaceUsed: 10})
+	waitForGossip(t, members[2], members[0].Addr(), func(m common.Member) bool {
+		return m.State == common.Alive && m.Meta.SpaceUsed == 10
+	})
+	waitForGossip(t, members[2], members[1].Addr(), func(m common.Member) bool {
+		return m.State == common.Alive && m.Meta.SpaceUsed == 1
+	})
+	members[0].Stop()
+	for _, g := range members[1:] {
+		waitForGossip(t, g, members[0].Addr(), func(m common.Member) bool {
+			return m.State == common.Dead
+		})
+	}
+	for _, m := range members[2].Members() {
+		if m.Addr == members[1].Addr() && m.State != common.Alive {
+			t.Error(m.Addr, "is", m.State, "instead of alive")
+		}
+	}
+
+	removeDatabase("gossip.test.db")
+	defer removeDatabase("gossip.test.db")
+	dirs := []string{"_data_gossip1", "_data_gossip2", "_data_gossip3"}
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	clientListener, clusterListener, gossipListener := listen(t), listen(t), listenPacket(t)
+	mdn, err := metadatanode.Create(metadatanode.Config{
+		ClientListener:    clientListener,
+		ClusterListener:   clusterListener,
+		ReplicationFactor: 2,
+		DatabaseFile:      "gossip.test.db",
+		MinBlockSize:      64,
+		// Only gossip can tell it a DataNode is gone
+		DataNodeTimeout:  time.Hour,
+		GossipListener:   gossipListener,
+		ProbeInterval:    100 * time.Millisecond,
+		SuspicionTimeout: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdn.Stop()
+
+	var dns []*datanode.DataNodeState
+	for _, dir := range dirs {
+		dn, err := datanode.Create(datanode.Config{
+			Listener:          listen(t),
+			LeaderAddress:     clusterListener.Addr().String(),
+			DataDir:           dir,
+			HeartbeatInterval: 200 * time.Millisecond,
+			IntegrityInterval: time.Hour,
+			GossipListener:    listenPacket(t),
+			GossipSeeds:       []string{gossipListener.LocalAddr().String()},
+			ProbeInterval:     100 * time.Millisecond,
+			SuspicionTimeout:  500 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dn.Stop()
+		dns = append(dns, dn)
+	}
+	waitForRegistration(dns...)
+
+	original, err := ioutil.ReadFile("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c := client.New(clientListener.Addr().String(), false)
+	c.BlockSize = 256
+	blobID, err := c.Upload(ctx, bytes.NewReader(original), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForReplicas(clientListener.Addr().String(), blobID, 2)
+
+	blocks, err := mdn.GetBlob(blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := dns[0]
+	for _, dn := range dns {
+		for _, addr := range mdn.GetBlock(blocks[0]) {
+			if addr == dn.Addr {
+				dead = dn
+			}
+		}
+	}
+	dead.Stop()
+	for _, b := range blocks {
+		for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+			addrs := mdn.GetBlock(b)
+			replaced := len(addrs) == 2
+			for _, addr := range addrs {
+				replaced = replaced && addr != dead.Addr
+			}
+			if replaced {
+				break
+			}
+			if time.Since(start) > 10*time.Second {
+				t.Fatal("Block", b, "is on", addrs, "after its DataNode", dead.Addr, "died")
+			}
+		}
+	}
+
+	r, err := c.Open(ctx, blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if downloaded, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(downloaded, original) {
+		t.Error("Couldn't download blob", blobID, err)
+	}
+}
+
+// Until the member knows addr to be how ok wants it
+func waitForGossip(t *testing.T, g *common.Gossip, addr string, ok func(common.Member) bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		for _, m := range g.Members() {
+			if m.Addr == addr && ok(m) {
+				return
+			}
+		}
+	}
+	t.Fatal(g.Addr(), "never heard the news about", addr, "->", g.Members())
+}
+
+// The last index in a MetaDataNode's Raft log
+func lastRaftIndex(t *testing.T, database string) uint64 {
+	db, err := sql.Open("sqlite3", database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var index uint64
+	if err := db.QueryRow("SELECT IFNULL(MAX(idx), 0) FROM raft_log").Scan(&index); err != nil {
+		t.Fatal(err)
+	}
+	if index == 0 {
+		return raftSnapshotIndex(t, database)
+	}
+	return index
+}
+
+func raftSnapshotIndex(t *testing.T, database string) uint64 {
+	db, err := sql.Open("sqlite3", database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var index uint64
+	if err := db.QueryRow("SELECT snapshot_index FROM raft_state").Scan(&index); err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func waitForLeader(t *testing.T, mdns []*metadatanode.MetaDataNodeState) *metadatanode.MetaDataNodeState {
+	for i := 0; i < 100; i++ {
+		for _, mdn := range mdns {
+			if mdn.IsLeader() {
+				return mdn
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("No leader elected")
+	return nil
+}
+
+func hasFile(database string, path string) bool {
+	db, err := metadatanode.OpenDB(database, false)
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	_, found, err := db.Lookup(path)
+	return err == nil && found
+}
+
+func readPath(ctx context.Context, c *client.Client, path string) ([]byte, error) {
+	r, err := c.OpenPath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func listenPacket(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func removeDatabase(filename string) {
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm", ".edits"} {
+		os.Remove(filename + suffix)
+	}
 }
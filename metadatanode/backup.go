@@ -0,0 +1,55 @@
+package metadatanode
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Hands a consistent copy of the metadata store to send without stopping
+// the server. Reads carry on while it's taken, writes wait.
+func (self *MetaDataNodeState) Backup(send func(size int64, data io.Reader) error) error {
+	tmp, err := ioutil.TempFile("", "metadata-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	self.mutex.RLock()
+	err = self.store.Backup(tmp.Name())
+	self.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	log.Println("Backed up", info.Size(), "bytes of metadata")
+	return send(info.Size(), tmp)
+}
+
+// Replaces the database with a backup before the MetaDataNode starts. The
+// database it replaces is kept next to it. Blocks the backup doesn't know
+// about are swept up as orphans once DataNodes re-register, and blocks it
+// expects that are gone show up as under-replicated.
+func Restore(backup string, filename string) error {
+	if _, err := os.Stat(filename); err == nil {
+		// Along with its edits that weren't checkpointed
+		for _, suffix := range []string{"", "-wal", ".edits"} {
+			err := os.Rename(filename+suffix, filename+".before-restore"+suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		log.Println("Moved", filename, "to", filename+".before-restore")
+	}
+	for _, f := range []string{filename + "-journal", filename + "-wal", filename + "-shm", editLogFile(filename)} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return copyFile(backup, filename)
+}
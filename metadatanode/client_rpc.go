@@ -1,6 +1,7 @@
 package metadatanode
 
 import (
+	"io"
 	"log"
 	"net"
 
@@ -17,40 +18,130 @@ func runClientRPC(c net.Conn, mdn *MetaDataNodeState) {
 		log.Println(err)
 		return
 	}
+	// Promote is for a standby, not whoever it would redirect to
+	if leader, isLeader := mdn.leaderAddress(false); !isLeader && method != "Promote" {
+		server.Error(NotLeaderError(leader))
+		return
+	}
 	switch method {
 	case "CreateBlob":
-		if err := server.ReadBody(nil); err != nil {
-			// TODO: Fatal bc I want to see if passing nil fails
-			log.Fatalln(err)
+		var msg CreateBlobMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
 			return
 		}
-		blobID := mdn.GenerateBlobId()
-		server.Send(&blobID)
-		var blocks []BlockID
-
-		for {
-			method, err = server.ReadHeader()
-			if err != nil {
-				// TODO: Handle this better: remove blob, blocks?
-				log.Fatalln(err)
+		if mdn.redirectOwner(server, PathKey(msg.Path)) {
+			return
+		}
+		if msg.Path != "" {
+			var err error
+			if msg.Path, err = mdn.CheckCreate(msg.Path); err != nil {
+				server.Error(err.Error())
 				return
 			}
-			switch method {
-			case "Append":
-				forwardBlock := mdn.GenerateBlock(blobID)
-				blocks = append(blocks, forwardBlock.BlockID)
-				server.Send(&forwardBlock)
-
-			case "Commit":
-				mdn.CommitBlob(blobID, blocks)
-				log.Println("Committed blob '"+blobID+"' for", c.RemoteAddr())
-				server.SendOkay()
-				return
+		}
+		lease, err := mdn.CreateBlob(msg.Path, msg.BlockSize, msg.ReplicationFactor)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.Send(&lease)
 
-			default:
-				server.Unacceptable()
-			}
+	case "Append":
+		var msg LeaseMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
 		}
+		if mdn.redirectOwner(server, BlobKey(msg.BlobID)) {
+			return
+		}
+		forwardBlock, err := mdn.Append(msg.BlobID, msg.Token)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.Send(&forwardBlock)
+
+	case "ReplaceTargets":
+		var msg ReplaceTargetsMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(msg.BlobID)) {
+			return
+		}
+		forwardBlock, err := mdn.ReplaceTargets(msg.BlobID, msg.Token, msg.BlockID, msg.Excluded, msg.Kept)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.Send(&forwardBlock)
+
+	case "RenewLease":
+		var msg LeaseMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(msg.BlobID)) {
+			return
+		}
+		expires, err := mdn.RenewLease(msg.BlobID, msg.Token)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.Send(&expires)
+
+	case "AckBlock":
+		var msg AckBlockMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(msg.BlobID)) {
+			return
+		}
+		if err := mdn.AckBlock(msg.BlobID, msg.Token, msg.Block, msg.Replicas); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.SendOkay()
+
+	case "ResumeBlob":
+		var msg ResumeMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(msg.BlobID)) {
+			return
+		}
+		resume, err := mdn.ResumeBlob(msg.BlobID, msg.ResumeToken)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		log.Println("Resuming blob '"+msg.BlobID+"' for", c.RemoteAddr())
+		server.Send(&resume)
+
+	case "Commit":
+		var msg CommitMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(msg.BlobID)) {
+			return
+		}
+		if err := mdn.CommitBlob(msg.BlobID, msg.Token, msg.Blocks); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		log.Println("Committed blob '"+msg.BlobID+"' for", c.RemoteAddr())
+		server.SendOkay()
 
 	case "GetBlob":
 		var blobID string
@@ -58,15 +149,209 @@ func runClientRPC(c net.Conn, mdn *MetaDataNodeState) {
 			log.Println(err)
 			return
 		}
-		blocks := mdn.GetBlob(blobID)
+		if mdn.redirectOwner(server, BlobKey(blobID)) {
+			return
+		}
+		blocks, err := mdn.GetBlob(blobID)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.Send(&blocks)
+
+	case "GetBlobBlocks":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(blobID)) {
+			return
+		}
+		blocks, err := mdn.GetBlobBlocks(blobID)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
 		server.Send(&blocks)
 
+	case "DeleteBlob":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(blobID)) {
+			return
+		}
+		if err := mdn.DeleteBlob(blobID); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.SendOkay()
+
+	case "StatBlob":
+		var blobID string
+		if err := server.ReadBody(&blobID); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(blobID)) {
+			return
+		}
+		info, err := mdn.StatBlob(blobID)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.Send(&info)
+
+	case "Backup":
+		if err := server.ReadBody(nil); err != nil {
+			log.Println(err)
+			return
+		}
+		sent := false
+		err := mdn.Backup(func(size int64, data io.Reader) error {
+			// The client reads exactly size bytes after this
+			sent = true
+			if err := server.Send(&size); err != nil {
+				return err
+			}
+			_, err := io.Copy(c, data)
+			return err
+		})
+		if err != nil {
+			log.Println("Backup error:", err)
+			if !sent {
+				server.Error(err.Error())
+			}
+		}
+
+	case "Promote":
+		if err := server.ReadBody(nil); err != nil {
+			log.Println(err)
+			return
+		}
+		if err := mdn.Promote(); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.SendOkay()
+
+	case "SetReplication":
+		var msg SetReplicationMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, BlobKey(msg.BlobID)) {
+			return
+		}
+		if err := mdn.SetReplication(msg.BlobID, msg.ReplicationFactor); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.SendOkay()
+
+	case "Mkdir":
+		var p string
+		if err := server.ReadBody(&p); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, PathKey(p)) {
+			return
+		}
+		if err := mdn.Mkdir(p); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.SendOkay()
+
+	case "List":
+		var p string
+		if err := server.ReadBody(&p); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, PathKey(p)) {
+			return
+		}
+		entries, err := mdn.List(p)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.Send(&entries)
+
+	case "Stat":
+		var p string
+		if err := server.ReadBody(&p); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, PathKey(p)) {
+			return
+		}
+		info, err := mdn.Stat(p)
+		if err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.Send(&info)
+
+	case "Rename":
+		var msg RenameMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, PathKey(msg.From)) {
+			return
+		}
+		if err := mdn.Rename(msg.From, msg.To); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.SendOkay()
+
+	case "Delete":
+		var msg DeleteMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if mdn.redirectOwner(server, PathKey(msg.Path)) {
+			return
+		}
+		if err := mdn.Delete(msg.Path, msg.Recursive); err != nil {
+			server.Error(err.Error())
+			return
+		}
+		server.SendOkay()
+
+	case "Federation":
+		if err := server.ReadBody(nil); err != nil {
+			log.Println(err)
+			return
+		}
+		// Empty without a federation: net/rpc won't take a null result
+		members := []string{}
+		if mdn.ring != nil {
+			members = mdn.ring.Members()
+		}
+		server.Send(&members)
+
 	case "GetBlock":
 		var blockID BlockID
 		if err := server.ReadBody(&blockID); err != nil {
 			log.Println(err)
 			return
 		}
+		if mdn.redirectOwner(server, BlobKey(string(blockID))) {
+			return
+		}
 		nodes := mdn.GetBlock(blockID)
 		server.Send(&nodes)
 
@@ -81,6 +366,9 @@ func (self *MetaDataNodeState) ClientRPCServer(sock net.Listener) {
 	for {
 		client, err := sock.Accept()
 		if err != nil {
+			if self.isStopped() {
+				return
+			}
 			log.Fatal(err)
 		}
 		go runClientRPC(client, self)
@@ -17,6 +17,12 @@ func runClusterRPC(c net.Conn, mdn *MetaDataNodeState) {
 		log.Println(err)
 		return
 	}
+	// Standbys hear from DataNodes too, so they know where blocks are
+	standby := mdn.isStandby()
+	if leader, isLeader := mdn.leaderAddress(true); !isLeader && !standby {
+		server.Error(NotLeaderError(leader))
+		return
+	}
 	switch method {
 	case "Register":
 		var reg RegistrationMsg
@@ -25,6 +31,7 @@ func runClusterRPC(c net.Conn, mdn *MetaDataNodeState) {
 			return
 		}
 		nodeID := mdn.RegisterDataNode(reg.Addr, reg.Blocks)
+		mdn.waitingChanged()
 		server.Send(&nodeID)
 		log.Println("DataNode '"+string(nodeID)+"' with", len(reg.Blocks), "blocks registered at", reg.Addr)
 
@@ -35,6 +42,7 @@ func runClusterRPC(c net.Conn, mdn *MetaDataNodeState) {
 			return
 		}
 		var resp HeartbeatResponse
+		resp.Standby = standby
 		// If we don't recognize the node, it needs to re-register
 		resp.NeedToRegister = !mdn.HeartbeatFrom(msg.NodeID, msg.SpaceUsed)
 		if resp.NeedToRegister {
@@ -51,6 +59,11 @@ func runClusterRPC(c net.Conn, mdn *MetaDataNodeState) {
 		for _, blockID := range msg.DeadBlocks {
 			log.Println("Block '" + string(blockID) + "' de-registered from " + string(msg.NodeID))
 		}
+		// A standby only listens until it's promoted
+		if standby {
+			server.Send(&resp)
+			return
+		}
 		// Tell this node to delete blocks
 		resp.InvalidateBlocks = mdn.deletionIntents.Get(msg.NodeID)
 		// Tell this node to forward blocks
@@ -59,12 +72,22 @@ func runClusterRPC(c net.Conn, mdn *MetaDataNodeState) {
 			for _, n := range nodes {
 				addrs = append(addrs, mdn.dataNodes[n])
 			}
-			resp.ToReplicate = append(resp.ToReplicate, ForwardBlock{block, addrs, -1})
+			resp.ToReplicate = append(resp.ToReplicate, ForwardBlock{block, addrs, -1, ""})
 		}
+		// It's been sent everything that was waiting for it
+		mdn.waitingChanged()
 		if err := server.Send(&resp); err != nil {
 			log.Fatalln(err)
 		}
 
+	case "TailEdits":
+		var msg TailEditsMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		mdn.tailEdits(c, server, msg)
+
 	default:
 		log.Println("Unacceptable:", method)
 		server.Unacceptable()
@@ -76,6 +99,9 @@ func (self *MetaDataNodeState) ClusterRPCServer(sock net.Listener) {
 	for {
 		peer, err := sock.Accept()
 		if err != nil {
+			if self.isStopped() {
+				return
+			}
 			log.Fatal(err)
 		}
 		go runClusterRPC(peer, self)
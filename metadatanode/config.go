@@ -2,6 +2,7 @@ package metadatanode
 
 import (
 	"net"
+	"time"
 )
 
 type Config struct {
@@ -9,4 +10,54 @@ type Config struct {
 	ClusterListener   net.Listener
 	ReplicationFactor int
 	DatabaseFile      string
+	// Migrate an out of date database, after saving a rollback snapshot
+	Upgrade bool
+	// The other MetaDataNodes' Raft addresses. Edits are only made once most
+	// of the MetaDataNodes have them, and only the leader serves. Without a
+	// Raft listener, this MetaDataNode is on its own.
+	RaftListener net.Listener
+	Peers        []string
+	// Cluster address of the primary MetaDataNode, to stand by for it
+	// without Raft. A standby copies the primary's edits and hears from
+	// DataNodes, but doesn't serve until it's promoted.
+	Primary string
+	// Client addresses of every MetaDataNode in a federation, this one
+	// included as it's advertised. Each is in charge of its own part of the
+	// hash ring, without Raft or standbys.
+	Federation []string
+	// Without Raft, how many edits the edit log holds before they're
+	// checkpointed into the database. Defaults to 1000.
+	CheckpointEdits int
+	// How long to go without hearing from the leader before electing a new
+	// one. Defaults to 1 second.
+	ElectionTimeout time.Duration
+	// With Raft, how many applied entries the log keeps once it's compacted.
+	// Followers that need older ones get a copy of the database instead.
+	// Defaults to 1000.
+	RaftLogEntries int
+	// How other machines reach this MetaDataNode, for redirects. Defaults to
+	// the listeners' own addresses.
+	Host string
+	// For blobs that don't ask for one. Defaults to 128MB.
+	BlockSize int64
+	// Bounds on what blobs can ask for. Default to 1MB and 1GB.
+	MinBlockSize int64
+	MaxBlockSize int64
+	// How long a block can go without being part of a blob before it's
+	// deleted. Defaults to 10 minutes.
+	OrphanGracePeriod time.Duration
+	// How long a DataNode can go without being heard from before it's
+	// forgotten. Defaults to 10 seconds.
+	DataNodeTimeout time.Duration
+	// Gossips with the DataNodes over this, to hear which are alive and how
+	// full they are without waiting for their heartbeats. DataNodes that
+	// gossip only heartbeat when they have something to say or are waited
+	// for.
+	GossipListener   net.PacketConn
+	GossipSeeds      []string
+	ProbeInterval    time.Duration // Defaults to 1 second
+	SuspicionTimeout time.Duration // Defaults to 5 probe intervals
+	// How long an upload lease lasts without being renewed. Defaults to 5
+	// minutes.
+	LeaseDuration time.Duration
 }
@@ -0,0 +1,179 @@
+package metadatanode
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Without Raft, every edit is appended here and synced to disk before it's
+// applied. The database itself isn't synced on every edit, only when the
+// log is checkpointed into it, so edits it lost in a crash are replayed
+// from here at startup.
+type editLog struct {
+	file  *os.File
+	edits []loggedEdit // Since the last checkpoint, for standbys catching up
+}
+
+type loggedEdit struct {
+	Index uint64
+	Edit  Edit
+}
+
+func editLogFile(filename string) string {
+	return filename + ".edits"
+}
+
+// Returns the edits in the log too. A partly written edit at the end is from
+// a crash before it was acknowledged, so it's dropped.
+func openEditLog(filename string) (*editLog, []loggedEdit, error) {
+	_, statErr := os.Stat(filename)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if os.IsNotExist(statErr) {
+		// Make sure the new file's directory entry survives a crash
+		if err := syncDir(filepath.Dir(filename)); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+
+	var edits []loggedEdit
+	var good int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Println("Dropping a partly written edit from", filename)
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		var edit loggedEdit
+		if err := json.Unmarshal(line, &edit); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("Corrupt edit log '%s' at offset %d: %v", filename, good, err)
+		}
+		if len(edits) > 0 && edit.Index != edits[len(edits)-1].Index+1 {
+			file.Close()
+			return nil, nil, fmt.Errorf("Edit log '%s' skips from %d to %d", filename, edits[len(edits)-1].Index, edit.Index)
+		}
+		edits = append(edits, edit)
+		good += int64(len(line))
+	}
+	if err := file.Truncate(good); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(good, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &editLog{file, edits}, edits, nil
+}
+
+// Returns once the edit is on disk
+func (self *editLog) append(index uint64, edit Edit) error {
+	logged := loggedEdit{index, edit}
+	line, err := json.Marshal(logged)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := self.file.Write(line); err != nil {
+		return err
+	}
+	self.edits = append(self.edits, logged)
+	return self.file.Sync()
+}
+
+// Empties the log, once everything in it is checkpointed
+func (self *editLog) truncate() error {
+	if err := self.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := self.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	self.edits = nil
+	return self.file.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Lets the database put off syncing until a checkpoint. SQLite's
+// write-ahead log keeps it consistent after a crash, though the last edits
+// can be missing.
+func (self *DB) syncOnCheckpoint() error {
+	var mode string
+	if err := self.conn.QueryRow("PRAGMA journal_mode=WAL").Scan(&mode); err != nil {
+		return err
+	}
+	if mode != "wal" {
+		return fmt.Errorf("Couldn't switch the database to WAL mode, it's in %s mode", mode)
+	}
+	_, err := self.conn.Exec("PRAGMA synchronous=NORMAL")
+	return err
+}
+
+// Moves everything SQLite has written into the database file and syncs it
+func (self *DB) Checkpoint() error {
+	var busy, frames, checkpointed int
+	if err := self.conn.QueryRow("PRAGMA wal_checkpoint(FULL)").Scan(&busy, &frames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("Checkpoint only got through %d of %d frames", checkpointed, frames)
+	}
+	return nil
+}
+
+// Must hold mutex
+func (self *MetaDataNodeState) checkpoint() {
+	if err := self.store.Checkpoint(); err != nil {
+		log.Println("Checkpoint failed, keeping the edit log:", err)
+		return
+	}
+	if err := self.editLog.truncate(); err != nil {
+		log.Fatalln("Edit log:", err)
+	}
+}
+
+// Applies the edits the database doesn't have yet
+func (self *MetaDataNodeState) replay(edits []loggedEdit) error {
+	if len(edits) > 0 && edits[0].Index > self.applied+1 {
+		return fmt.Errorf("Edit log starts at %d but the database only has edits up to %d", edits[0].Index, self.applied)
+	}
+	replayed := 0
+	for _, e := range edits {
+		if e.Index <= self.applied {
+			continue
+		}
+		if _, err := self.store.Apply(e.Index, e.Edit); err != nil {
+			log.Println("Replayed edit", e.Index, "failed like it did the first time:", err)
+		}
+		self.applied = e.Index
+		replayed++
+	}
+	if replayed > 0 {
+		log.Println("Replayed", replayed, "edits from the edit log")
+	}
+	return nil
+}
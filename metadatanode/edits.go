@@ -0,0 +1,95 @@
+package metadatanode
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// A change to the metadata store. Every change is made through one so that
+// MetaDataNodes can apply the same changes in the same order. Only the fields
+// the operation needs are set.
+type Edit struct {
+	Op          string
+	BlobID      string
+	Path        string
+	To          string
+	Recursive   bool
+	BlockSize   int64
+	Replication int
+	Blocks      []BlockInfo
+	Time        time.Time
+}
+
+// Returns the deleted blobs for Delete and the deleted blocks for DeleteBlob
+func (self Edit) apply(tx *sql.Tx) ([]string, error) {
+	switch self.Op {
+	case "ForgetOpenBlobs":
+		return nil, forgetOpenBlobs(tx)
+	case "CreateBlob":
+		return nil, createBlob(tx, self.BlobID, self.BlockSize, self.Replication, self.Time)
+	case "AbandonBlob":
+		return nil, abandonBlob(tx, self.BlobID)
+	case "CommitBlob":
+		// Links the blob at its path too, if it was created with one
+		if self.Path != "" {
+			if err := createFile(tx, self.Path, self.BlobID); err != nil {
+				return nil, err
+			}
+		}
+		return nil, commitBlob(tx, self.BlobID, self.Blocks, self.Time)
+	case "DeleteBlob":
+		return deleteBlob(tx, self.BlobID)
+	case "SetReplication":
+		return nil, setReplication(tx, self.BlobID, self.Replication)
+	case "Mkdir":
+		return nil, mkdirs(tx, self.Path)
+	case "Rename":
+		return nil, rename(tx, self.Path, self.To)
+	case "Delete":
+		return deletePath(tx, self.Path, self.Recursive)
+	}
+	return nil, errors.New("Unknown edit '" + self.Op + "'")
+}
+
+// Applies the edit and records index as the last one applied, in one
+// transaction. An edit that fails changes nothing but still counts as
+// applied, since it fails the same way everywhere. The store can't carry on
+// if it can't record an edit.
+func (self *DB) Apply(index uint64, edit Edit) ([]string, error) {
+	tx, err := self.conn.Begin()
+	if err != nil {
+		log.Fatalln("Applying edit:", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SAVEPOINT edit"); err != nil {
+		log.Fatalln("Applying edit:", err)
+	}
+	result, editErr := edit.apply(tx)
+	if editErr != nil {
+		if _, err := tx.Exec("ROLLBACK TO edit"); err != nil {
+			log.Fatalln("Applying edit:", err)
+		}
+	}
+	if _, err := tx.Exec("RELEASE edit"); err != nil {
+		log.Fatalln("Applying edit:", err)
+	}
+	if _, err := tx.Exec("UPDATE raft_state SET applied=?", index); err != nil {
+		log.Fatalln("Applying edit:", err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalln("Applying edit:", err)
+	}
+	return result, editErr
+}
+
+// Index of the last edit applied
+func (self *DB) Applied() (uint64, error) {
+	var applied uint64
+	err := self.conn.QueryRow("SELECT applied FROM raft_state").Scan(&applied)
+	return applied, err
+}
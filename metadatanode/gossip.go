@@ -0,0 +1,96 @@
+package metadatanode
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// With gossip, DataNodes are heard from through the other members instead of
+// each of them heartbeating every MetaDataNode. A DataNode still heartbeats
+// to report blocks, and when the MetaDataNode says through gossip that it's
+// waiting to hear from it: to send it commands, or because it hasn't
+// registered here.
+
+// Takes in what gossip found out about a DataNode
+func (self *MetaDataNodeState) gossipChanged(m Member) {
+	if m.Meta.DataNode == "" {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	nodeID, ok := self.dataNodeAt(m.Meta.DataNode)
+	switch {
+	case !ok:
+		self.updateWaiting()
+	case m.State == Dead:
+		log.Println("Gossip found DataNode '" + nodeID + "' dead, forgetting it")
+		self.forgetDataNode(nodeID)
+		self.updateWaiting()
+	default:
+		self.dataNodesLastSeen[nodeID] = time.Now()
+		self.dataNodesUtilization[nodeID] = m.Meta.SpaceUsed
+	}
+}
+
+// DataNodes gossip says are alive count as heard from, with the space they
+// say they use. Must hold mutex.
+func (self *MetaDataNodeState) heardThroughGossip() {
+	if self.gossip == nil {
+		return
+	}
+	for _, m := range self.gossip.Members() {
+		if m.Meta.DataNode == "" || m.State == Dead {
+			continue
+		}
+		if nodeID, ok := self.dataNodeAt(m.Meta.DataNode); ok {
+			self.dataNodesLastSeen[nodeID] = time.Now()
+			self.dataNodesUtilization[nodeID] = m.Meta.SpaceUsed
+		}
+	}
+}
+
+// Must hold mutex
+func (self *MetaDataNodeState) dataNodeAt(addr string) (NodeID, bool) {
+	for nodeID, a := range self.dataNodes {
+		if a == addr {
+			return nodeID, true
+		}
+	}
+	return "", false
+}
+
+func (self *MetaDataNodeState) waitingChanged() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.updateWaiting()
+}
+
+// Tells DataNodes through gossip which of them to heartbeat: the ones with
+// commands waiting, and the ones that haven't registered. A Raft follower
+// waits for nobody. Must hold mutex.
+func (self *MetaDataNodeState) updateWaiting() {
+	if self.gossip == nil {
+		return
+	}
+	var waiting []string
+	if self.raft == nil || self.raft.isLeader() {
+		for nodeID, addr := range self.dataNodes {
+			if self.deletionIntents.Pending(nodeID) || self.replicationIntents.Pending(nodeID) {
+				waiting = append(waiting, addr)
+			}
+		}
+		for _, m := range self.gossip.Members() {
+			if m.Meta.DataNode == "" || m.State == Dead {
+				continue
+			}
+			if _, ok := self.dataNodeAt(m.Meta.DataNode); !ok {
+				waiting = append(waiting, m.Meta.DataNode)
+			}
+		}
+	}
+	sort.Strings(waiting)
+	self.gossip.SetMeta(GossipMeta{MetaDataNode: self.clusterAddr, Waiting: waiting})
+}
@@ -57,6 +57,21 @@ func (self *ReplicationIntents) Get(node NodeID) map[BlockID][]NodeID {
 	return actions
 }
 
+// Whether the node has commands it hasn't been sent
+func (self *ReplicationIntents) Pending(node NodeID) bool {
+	for _, intent := range self.intents {
+		if intent.sentCommand {
+			continue
+		}
+		for _, n := range intent.availableFrom {
+			if n == node {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (self *ReplicationIntents) Done(node NodeID, block BlockID) {
 	for i, intent := range self.intents {
 		if intent.block != block {
@@ -73,6 +88,17 @@ func (self *ReplicationIntents) Done(node NodeID, block BlockID) {
 	}
 }
 
+// Drops the block's intents, e.g. when its pipeline is replaced
+func (self *ReplicationIntents) Forget(block BlockID) {
+	var intents []*replicationIntent
+	for _, intent := range self.intents {
+		if intent.block != block {
+			intents = append(intents, intent)
+		}
+	}
+	self.intents = intents
+}
+
 func (self *ReplicationIntents) InProgress(block BlockID) bool {
 	for i, intent := range self.intents {
 		if intent.block == block {
@@ -96,10 +122,15 @@ type DeletionIntents struct {
 	intents []*deletionIntent
 }
 
+// Skips nodes that are already deleting the block
 func (self *DeletionIntents) Add(block BlockID, from []NodeID) {
+Nodes:
 	for _, node := range from {
-		if self.InProgress(block) {
-			log.Fatalln("Already deleting block '" + string(block) + "' from '" + string(node) + "'")
+		for _, intent := range self.intents {
+			if intent.block == block && intent.node == node && time.Since(intent.startedAt) < 20*time.Second {
+				log.Println("Already deleting block '" + string(block) + "' from '" + string(node) + "'")
+				continue Nodes
+			}
 		}
 		self.intents = append(self.intents, &deletionIntent{time.Now(), false, block, node})
 	}
@@ -132,6 +163,16 @@ func (self *DeletionIntents) Get(node NodeID) []BlockID {
 	return deletions
 }
 
+// Whether the node has commands it hasn't been sent
+func (self *DeletionIntents) Pending(node NodeID) bool {
+	for _, intent := range self.intents {
+		if !intent.sentCommand && intent.node == node {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *DeletionIntents) Done(node NodeID, block BlockID) {
 	for i, intent := range self.intents {
 		if intent.node == node && intent.block == block {
@@ -1,9 +1,11 @@
 package metadatanode
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"sort"
 	"strings"
 	"sync"
@@ -21,86 +23,462 @@ type MetaDataNodeState struct {
 	dataNodes            map[NodeID]string
 	dataNodesLastSeen    map[NodeID]time.Time
 	dataNodesUtilization map[NodeID]int
+	dataNodesDemoted     map[NodeID]time.Time // Clients couldn't reach them
 	blocks               map[BlockID]map[NodeID]bool
 	dataNodesBlocks      map[NodeID]map[BlockID]bool
+	deletedBlocks        map[BlockID]bool // Until every replica is gone
+	unverifiedBlocks     map[BlockID]time.Time
+	openBlobs            map[string]*openBlob
+	blobReplication      map[string]int // Blobs from before it was recorded use ReplicationFactor
 	replicationIntents   ReplicationIntents
 	deletionIntents      DeletionIntents
 	ReplicationFactor    int
+	blockSize            int64
+	minBlockSize         int64
+	maxBlockSize         int64
+	orphanGracePeriod    time.Duration
+	leaseDuration        time.Duration
+	dataNodeTimeout      time.Duration
+	gossip               *Gossip  // Nil unless DataNodes gossip
+	raft                 *raft    // Nil without other MetaDataNodes
+	applied              uint64   // Index of the last edit, without Raft
+	editLog              *editLog // Nil with Raft, which has its own log
+	checkpointEdits      int
+	standby              *standby // Nil unless copying a primary's edits
+	standbys             map[chan loggedEdit]bool
+	clientAddr           string
+	clusterAddr          string
+	ring                 *HashRing // Nil without a federation
+	listeners            []net.Listener
+	stopped              bool
 }
 
 func Create(conf Config) (*MetaDataNodeState, error) {
 	self := new(MetaDataNodeState)
 
-	db, err := OpenDB(conf.DatabaseFile)
+	db, err := OpenDB(conf.DatabaseFile, conf.Upgrade)
 	log.Println("Persistent storage at", conf.DatabaseFile)
 	if err != nil {
 		log.Println("Metadata store error:", err)
 		return nil, err
 	}
 	self.store = db
+	self.resetVolatile()
 
+	self.ReplicationFactor = conf.ReplicationFactor
+	self.blockSize = conf.BlockSize
+	if self.blockSize == 0 {
+		self.blockSize = 128 * 1024 * 1024
+	}
+	self.minBlockSize = conf.MinBlockSize
+	if self.minBlockSize == 0 {
+		self.minBlockSize = 1024 * 1024
+	}
+	self.maxBlockSize = conf.MaxBlockSize
+	if self.maxBlockSize == 0 {
+		self.maxBlockSize = 1024 * 1024 * 1024
+	}
+	if self.blockSize < self.minBlockSize || self.blockSize > self.maxBlockSize {
+		err := fmt.Errorf("The default block size must be between %d and %d", self.minBlockSize, self.maxBlockSize)
+		log.Println(err)
+		return nil, err
+	}
+	self.orphanGracePeriod = conf.OrphanGracePeriod
+	if self.orphanGracePeriod == 0 {
+		self.orphanGracePeriod = 10 * time.Minute
+	}
+	self.leaseDuration = conf.LeaseDuration
+	if self.leaseDuration == 0 {
+		self.leaseDuration = 5 * time.Minute
+	}
+	self.dataNodeTimeout = conf.DataNodeTimeout
+	if self.dataNodeTimeout == 0 {
+		self.dataNodeTimeout = 10 * time.Second
+	}
+	self.checkpointEdits = conf.CheckpointEdits
+	if self.checkpointEdits == 0 {
+		self.checkpointEdits = 1000
+	}
+	self.listeners = []net.Listener{conf.ClientListener, conf.ClusterListener}
+	self.clientAddr = advertise(conf.Host, conf.ClientListener.Addr())
+	self.clusterAddr = advertise(conf.Host, conf.ClusterListener.Addr())
+	self.standbys = map[chan loggedEdit]bool{}
+	if len(conf.Federation) > 0 {
+		if conf.RaftListener != nil || conf.Primary != "" {
+			return nil, errors.New("A federated MetaDataNode can't have Raft peers or be a standby")
+		}
+		self.ring = NewHashRing(conf.Federation)
+		found := false
+		for _, m := range conf.Federation {
+			found = found || m == self.clientAddr
+		}
+		if !found {
+			return nil, errors.New("The federation doesn't include this MetaDataNode at " + self.clientAddr)
+		}
+		log.Println("Federated with", conf.Federation)
+	}
+
+	if conf.RaftListener == nil {
+		if len(conf.Peers) > 0 {
+			return nil, errors.New("Need a Raft listener to have peers")
+		}
+		if conf.Primary != "" {
+			self.standby = &standby{primary: conf.Primary}
+		}
+		if self.applied, err = db.Applied(); err != nil {
+			log.Println("Metadata store error:", err)
+			return nil, err
+		}
+		if err := db.syncOnCheckpoint(); err != nil {
+			log.Println("Metadata store error:", err)
+			return nil, err
+		}
+		var edits []loggedEdit
+		self.editLog, edits, err = openEditLog(editLogFile(conf.DatabaseFile))
+		if err != nil {
+			log.Println("Edit log error:", err)
+			return nil, err
+		}
+		if err := self.replay(edits); err != nil {
+			log.Println("Edit log error:", err)
+			return nil, err
+		}
+		self.checkpoint()
+		// A standby's edits all come from the primary, it forgets open
+		// blobs when it's promoted
+		if self.standby == nil {
+			if _, err := self.edit(Edit{Op: "ForgetOpenBlobs"}); err != nil {
+				log.Println("Metadata store error:", err)
+				return nil, err
+			}
+		}
+		if self.blobReplication, err = db.Replication(); err != nil {
+			log.Println("Metadata store error:", err)
+			return nil, err
+		}
+	} else {
+		if conf.Primary != "" {
+			return nil, errors.New("A standby can't have Raft peers")
+		}
+		electionTimeout := conf.ElectionTimeout
+		if electionTimeout == 0 {
+			electionTimeout = time.Second
+		}
+		keepEntries := conf.RaftLogEntries
+		if keepEntries == 0 {
+			keepEntries = 1000
+		}
+		self.raft, err = newRaft(db, conf.RaftListener, advertise(conf.Host, conf.RaftListener.Addr()),
+			advertise(conf.Host, conf.ClientListener.Addr()), advertise(conf.Host, conf.ClusterListener.Addr()),
+			conf.Peers, electionTimeout, keepEntries)
+		if err != nil {
+			log.Println("Metadata store error:", err)
+			return nil, err
+		}
+		self.raft.onLeader = self.becameLeader
+		self.raft.onFollower = self.stoppedLeading
+		self.raft.start()
+	}
+
+	if conf.GossipListener != nil {
+		// Held so gossip doesn't report a change before it's set
+		self.mutex.Lock()
+		self.gossip = NewGossip(GossipConfig{
+			Conn:             conf.GossipListener,
+			Addr:             advertise(conf.Host, conf.GossipListener.LocalAddr()),
+			Seeds:            conf.GossipSeeds,
+			Meta:             GossipMeta{MetaDataNode: self.clusterAddr},
+			ProbeInterval:    conf.ProbeInterval,
+			SuspicionTimeout: conf.SuspicionTimeout,
+			Notify:           self.gossipChanged,
+		})
+		self.mutex.Unlock()
+	}
+
+	go self.Monitor()
+	go self.ClientRPCServer(conf.ClientListener)
+	go self.ClusterRPCServer(conf.ClusterListener)
+	if self.standby != nil {
+		log.Println("Standing by for the primary at", conf.Primary)
+		go self.tailPrimary()
+	}
+
+	return self, nil
+}
+
+// Everything that isn't in the store: DataNodes, where blocks are, and
+// uploads in progress. A new leader starts over and learns it again.
+func (self *MetaDataNodeState) resetVolatile() {
 	self.dataNodesLastSeen = map[NodeID]time.Time{}
 	self.dataNodes = map[NodeID]string{}
 	self.dataNodesUtilization = map[NodeID]int{}
+	self.dataNodesDemoted = map[NodeID]time.Time{}
 	self.blocks = map[BlockID]map[NodeID]bool{}
 	self.dataNodesBlocks = map[NodeID]map[BlockID]bool{}
+	self.deletedBlocks = map[BlockID]bool{}
+	self.unverifiedBlocks = map[BlockID]time.Time{}
+	self.openBlobs = map[string]*openBlob{}
+	self.blobReplication = map[string]int{}
+	self.replicationIntents = ReplicationIntents{}
+	self.deletionIntents = DeletionIntents{}
+}
 
-	self.ReplicationFactor = conf.ReplicationFactor
-	go self.Monitor()
-	go self.ClientRPCServer(conf.ClientListener)
-	go self.ClusterRPCServer(conf.ClusterListener)
+// A listener's address, with host in place of its own if there is one
+func advertise(host string, addr net.Addr) string {
+	if host == "" {
+		return addr.String()
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return net.JoinHostPort(host, port)
+}
 
-	return self, nil
+// Makes a change to the store, through the other MetaDataNodes if there are
+// any, or else through the edit log. Must not hold mutex, since it waits for
+// the other MetaDataNodes to agree: callers check again whatever they checked
+// before, once they have the mutex back.
+func (self *MetaDataNodeState) propose(edit Edit) ([]string, error) {
+	if self.raft != nil {
+		return self.raft.propose(edit)
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.edit(edit)
 }
 
-func (self *MetaDataNodeState) GenerateBlobId() string {
-	u4, err := uuid.NewV4()
+// Logs the edit without Raft. Must hold mutex.
+func (self *MetaDataNodeState) edit(edit Edit) ([]string, error) {
+	if self.raft != nil {
+		return nil, errors.New("Edits go through Raft")
+	}
+	if err := self.editLog.append(self.applied+1, edit); err != nil {
+		log.Fatalln("Edit log:", err)
+	}
+	self.applied++
+	result, err := self.store.Apply(self.applied, edit)
+	self.sendToStandbys(loggedEdit{self.applied, edit})
+	if len(self.editLog.edits) >= self.checkpointEdits {
+		self.checkpoint()
+	}
+	return result, err
+}
+
+func (self *MetaDataNodeState) becameLeader(term uint64) {
+	self.mutex.Lock()
+	self.resetVolatile()
+	self.mutex.Unlock()
+	// Also commits an edit from this term, which applies every edit before it
+	if _, err := self.propose(Edit{Op: "ForgetOpenBlobs"}); err != nil {
+		log.Println("Taking over as leader:", err)
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.raft.isLeader() {
+		return
+	}
+	replication, err := self.store.Replication()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalln(err)
 	}
-	hash := sha1.Sum([]byte(u4.String()))
-	a := []byte{85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85, 85}
-	b := []byte{170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170, 170}
-	switch {
-	case bytes.Compare(hash[:], a) == -1:
-		log.Println("Blob in first third of circle")
-	case bytes.Compare(hash[:], b) == -1:
-		log.Println("Blob in second third of circle")
-	default:
-		log.Println("Blob in final third of circle")
+	self.blobReplication = replication
+	self.raft.setReady(term)
+	log.Println("Leading the MetaDataNodes in term", term)
+}
+
+func (self *MetaDataNodeState) stoppedLeading() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.raft.isLeader() {
+		self.resetVolatile()
 	}
+}
+
+// Where clients (or DataNodes, for cluster) should go, and whether it's
+// here. The address is empty while there's no leader. A standby sends them
+// to its primary.
+func (self *MetaDataNodeState) leaderAddress(cluster bool) (string, bool) {
+	if self.raft == nil {
+		self.mutex.RLock()
+		defer self.mutex.RUnlock()
+		if self.standby == nil {
+			return "", true
+		}
+		if cluster {
+			return self.standby.primary, false
+		}
+		return self.standby.primaryClient, false
+	}
+	client, clusterAddr, isLeader := self.raft.leaderAddrs()
+	if cluster {
+		return clusterAddr, isLeader
+	}
+	return client, isLeader
+}
 
-	return u4.String()
+// Whether this MetaDataNode is serving clients and DataNodes
+func (self *MetaDataNodeState) IsLeader() bool {
+	_, isLeader := self.leaderAddress(false)
+	return isLeader
 }
 
-func (self *MetaDataNodeState) GenerateBlock(blob string) ForwardBlock {
+// Stops serving and leaves the other MetaDataNodes, as if the process had
+// died. The store stays open.
+func (self *MetaDataNodeState) Stop() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.stopped = true
+	for _, l := range self.listeners {
+		l.Close()
+	}
+	if self.standby != nil && self.standby.conn != nil {
+		self.standby.conn.Close()
+	}
+	for edits := range self.standbys {
+		delete(self.standbys, edits)
+		close(edits)
+	}
+	if self.gossip != nil {
+		self.gossip.Stop()
+	}
+	if self.raft != nil {
+		self.raft.shutdown()
+	}
+}
+
+func (self *MetaDataNodeState) isStopped() bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.stopped
+}
+
+// In a federation, only IDs that land in this MetaDataNode's part of the
+// ring are used
+func (self *MetaDataNodeState) GenerateBlobId() string {
+	for {
+		u4, err := uuid.NewV4()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if self.owns(BlobKey(u4.String())) {
+			return u4.String()
+		}
+	}
+}
+
+// Whether this MetaDataNode is in charge of the ring key. Everything is
+// without a federation, and so is the empty key.
+func (self *MetaDataNodeState) owns(key string) bool {
+	return self.ring == nil || key == "" || self.ring.Owner(key) == self.clientAddr
+}
+
+// Sends the caller to the MetaDataNode in charge of key, if this isn't it.
+// Returns whether it did.
+func (self *MetaDataNodeState) redirectOwner(server *RPCServer, key string) bool {
+	if self.owns(key) {
+		return false
+	}
+	server.Error(NotLeaderError(self.ring.Owner(key)))
+	return true
+}
+
+// Must hold mutex
+func (self *MetaDataNodeState) generateBlock(blob string) ForwardBlock {
 	u4, err := uuid.NewV4()
 	if err != nil {
 		log.Fatalln(err)
 	}
 	block := BlockID(blob + ":" + u4.String())
+	return self.pipeline(block, self.openBlobs[blob], nil, nil)
+}
 
-	nodes := self.LeastUsedNodes()
+// Picks the least used nodes for a new block, leaving out excluded ones.
+// Nodes that kept the block count towards its replicas, but aren't sent it
+// again. Must hold mutex.
+func (self *MetaDataNodeState) pipeline(block BlockID, blob *openBlob, excluded map[NodeID]bool, kept []NodeID) ForwardBlock {
+	skip := map[NodeID]bool{}
+	for _, nodeID := range kept {
+		skip[nodeID] = true
+	}
 	var forwardTo []NodeID
-	if len(nodes) < self.ReplicationFactor {
-		forwardTo = nodes
-	} else {
-		forwardTo = nodes[0:self.ReplicationFactor]
+	for _, nodeID := range self.LeastUsedNodes() {
+		if len(kept)+len(forwardTo) < blob.replication && !excluded[nodeID] && !skip[nodeID] {
+			forwardTo = append(forwardTo, nodeID)
+		}
+	}
+	if blob.assigned[block] == nil {
+		blob.assigned[block] = map[NodeID]bool{}
 	}
+	blob.wanted[block] = len(kept) + len(forwardTo)
 	var addrs []string
 	for _, nodeID := range forwardTo {
+		blob.assigned[block][nodeID] = true
 		addrs = append(addrs, self.dataNodes[nodeID])
 	}
 
-	// Lock?
 	self.replicationIntents.Add(block, nil, forwardTo)
-	return ForwardBlock{block, addrs, 128 * 1024 * 1024}
+	return ForwardBlock{block, addrs, blob.blockSize, ""}
+}
+
+// How many replicas the blob that owns the block wants. Must hold mutex.
+func (self *MetaDataNodeState) replication(block BlockID) int {
+	blob := strings.SplitN(string(block), ":", 2)[0]
+	if open := self.openBlobs[blob]; open != nil {
+		return open.replication
+	}
+	if n := self.blobReplication[blob]; n > 0 {
+		return n
+	}
+	return self.ReplicationFactor
+}
+
+func (self *MetaDataNodeState) SetReplication(blobID string, n int) error {
+	if n < 1 {
+		return errors.New("Replication factor must be at least 1")
+	}
+	self.mutex.RLock()
+	err := self.checkBlob(blobID)
+	self.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if _, err := self.propose(Edit{Op: "SetReplication", BlobID: blobID, Replication: n}); err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	// Unless it was deleted while the edit was proposed
+	if err := self.checkBlob(blobID); err != nil {
+		return err
+	}
+	self.blobReplication[blobID] = n
+	log.Println("Replication factor of blob '"+blobID+"' is now", n)
+	return nil
 }
 
-func (self *MetaDataNodeState) GetBlob(blobID string) []BlockID {
+// Must hold mutex
+func (self *MetaDataNodeState) checkBlob(blobID string) error {
+	exists, err := self.store.HasBlob(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !exists {
+		return errors.New("No such blob: '" + blobID + "'")
+	}
+	return nil
+}
+
+func (self *MetaDataNodeState) GetBlob(blobID string) ([]BlockID, error) {
 	self.mutex.RLock()
 	defer self.mutex.RUnlock()
 
+	if err := self.checkBlob(blobID); err != nil {
+		return nil, err
+	}
 	names, err := self.store.Get(blobID)
 	if err != nil {
 		log.Fatalln(err)
@@ -112,17 +490,107 @@ func (self *MetaDataNodeState) GetBlob(blobID string) []BlockID {
 		blocks = append(blocks, BlockID(n))
 	}
 
-	return blocks
+	return blocks, nil
+}
+
+func (self *MetaDataNodeState) GetBlobBlocks(blobID string) ([]BlockInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	if err := self.checkBlob(blobID); err != nil {
+		return nil, err
+	}
+	blocks, err := self.store.GetBlocks(blobID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return blocks, nil
+}
+
+// Committed blobs come from the store, open ones from their upload
+func (self *MetaDataNodeState) StatBlob(blobID string) (BlobInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	info, err := self.store.StatBlob(blobID)
+	switch {
+	case err == sql.ErrNoRows:
+		return BlobInfo{}, errors.New("Blob doesn't exist: '" + blobID + "'")
+	case err != nil:
+		return BlobInfo{}, err
+	}
+	if open := self.openBlobs[blobID]; open != nil {
+		info.Blocks = append([]BlockInfo{}, open.acked...)
+		for _, b := range info.Blocks {
+			info.Size += b.Size
+		}
+	} else if info.Blocks, err = self.store.GetBlocks(blobID); err != nil {
+		return BlobInfo{}, err
+	}
+	if info.Replication == 0 {
+		info.Replication = self.ReplicationFactor
+	}
+	return info, nil
+}
+
+// The blob is gone as soon as this returns. Its blocks are deleted from
+// DataNodes as they heartbeat.
+func (self *MetaDataNodeState) DeleteBlob(blobID string) error {
+	self.mutex.RLock()
+	err := self.checkBlob(blobID)
+	self.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	blocks, err := self.propose(Edit{Op: "DeleteBlob", BlobID: blobID})
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.blobReplication, blobID)
+	for _, b := range blocks {
+		self.deleteBlock(BlockID(b))
+	}
+	log.Println("Deleted blob '"+blobID+"' with", len(blocks), "blocks")
+	return nil
+}
+
+// Must hold mutex
+func (self *MetaDataNodeState) deleteBlock(blockID BlockID) {
+	var nodes []NodeID
+	for n, _ := range self.blocks[blockID] {
+		nodes = append(nodes, n)
+	}
+	if len(nodes) > 0 {
+		self.deletedBlocks[blockID] = true
+		self.deletionIntents.Add(blockID, nodes)
+	}
 }
 
 func (self *MetaDataNodeState) HasBlocks(nodeID NodeID, blocks []BlockID) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
+	self.hasBlocks(nodeID, blocks)
+}
 
+// Blocks another federated MetaDataNode is in charge of are left to it.
+// Must hold mutex.
+func (self *MetaDataNodeState) hasBlocks(nodeID NodeID, blocks []BlockID) {
 	for _, blockID := range blocks {
+		if !self.owns(BlobKey(string(blockID))) {
+			continue
+		}
 		self.replicationIntents.Done(nodeID, blockID)
+		if self.deletedBlocks[blockID] {
+			// Finished replicating after the blob was deleted
+			self.deletionIntents.Add(blockID, []NodeID{nodeID})
+		}
 		if self.blocks[blockID] == nil {
 			self.blocks[blockID] = map[NodeID]bool{}
+			self.unverifiedBlocks[blockID] = time.Now()
 		}
 		if self.dataNodesBlocks[nodeID] == nil {
 			self.dataNodesBlocks[nodeID] = map[BlockID]bool{}
@@ -140,6 +608,10 @@ func (self *MetaDataNodeState) DoesntHaveBlocks(nodeID NodeID, blockIDs []BlockI
 		self.deletionIntents.Done(nodeID, blockID)
 		if self.blocks[blockID] != nil {
 			delete(self.blocks[blockID], nodeID)
+			if len(self.blocks[blockID]) == 0 {
+				delete(self.blocks, blockID)
+				delete(self.deletedBlocks, blockID)
+			}
 		}
 		if self.dataNodesBlocks[nodeID] != nil {
 			delete(self.dataNodesBlocks[nodeID], blockID)
@@ -151,6 +623,9 @@ func (self *MetaDataNodeState) GetBlock(blockID BlockID) []string {
 	self.mutex.RLock()
 	defer self.mutex.RUnlock()
 
+	if self.deletedBlocks[blockID] {
+		return nil
+	}
 	var addrs []string
 	for nodeID, _ := range self.blocks[blockID] {
 		addrs = append(addrs, self.dataNodes[nodeID])
@@ -185,6 +660,18 @@ func (self *MetaDataNodeState) HeartbeatFrom(nodeID NodeID, utilization int) boo
 	return false
 }
 
+// Must hold mutex
+func (self *MetaDataNodeState) forgetDataNode(id NodeID) {
+	delete(self.dataNodesLastSeen, id)
+	delete(self.dataNodes, id)
+	delete(self.dataNodesUtilization, id)
+	delete(self.dataNodesDemoted, id)
+	for block, _ := range self.dataNodesBlocks[id] {
+		delete(self.blocks[block], id)
+	}
+	delete(self.dataNodesBlocks, id)
+}
+
 func (self *MetaDataNodeState) Utilization(n NodeID) int {
 	return self.dataNodesUtilization[n] + self.replicationIntents.Count(n) - self.deletionIntents.Count(n)
 }
@@ -198,9 +685,18 @@ func (self *MetaDataNodeState) LeastUsedNodes() []NodeID {
 
 	sort.Sort(ByRandom(nodes))
 	sort.Stable(ByFunc(self.Utilization, nodes))
+	sort.Stable(ByFunc(self.demoted, nodes))
 
 	return nodes
 }
+
+// 1 if a client recently couldn't reach the node, so it's picked last
+func (self *MetaDataNodeState) demoted(n NodeID) int {
+	if time.Since(self.dataNodesDemoted[n]) < demotionPeriod {
+		return 1
+	}
+	return 0
+}
 func (self *MetaDataNodeState) MostUsedNodes() []NodeID {
 	var nodes []NodeID
 	for nodeID, _ := range self.dataNodes {
@@ -213,49 +709,59 @@ func (self *MetaDataNodeState) MostUsedNodes() []NodeID {
 	return nodes
 }
 
-func (self *MetaDataNodeState) CommitBlob(name string, blocks []BlockID) {
-	self.mutex.Lock()
-	defer self.mutex.Unlock()
-	for _, b := range blocks {
-		self.store.Append(name, string(b))
-	}
-}
-
 func (self *MetaDataNodeState) Monitor() {
-	for {
+	for ; !self.isStopped(); time.Sleep(3 * time.Second) {
+		self.mutex.Lock()
+		self.updateWaiting()
+		self.mutex.Unlock()
+		// Followers don't know about DataNodes or uploads
+		if !self.IsLeader() {
+			continue
+		}
 		log.Println("Monitor checking system..")
+		self.expireLeases()
 		// This sucks. Probably could do a separate lock for DataNodes and file stuff
 		self.mutex.Lock()
+		self.heardThroughGossip()
 		for id, lastSeen := range self.dataNodesLastSeen {
-			if time.Since(lastSeen) > 10*time.Second {
+			if time.Since(lastSeen) > self.dataNodeTimeout {
 				log.Println("Forgetting absent node:", id)
-				delete(self.dataNodesLastSeen, id)
-				delete(self.dataNodes, id)
-				delete(self.dataNodesUtilization, id)
-				for block, _ := range self.dataNodesBlocks[id] {
-					delete(self.blocks[block], id)
-				}
-				delete(self.dataNodesBlocks, id)
+				self.forgetDataNode(id)
 			}
 		}
 
 		for blockID, nodes := range self.blocks {
+			replication := self.replication(blockID)
 			switch {
 			default:
 				continue
 
+			case len(nodes) == 0:
+				delete(self.blocks, blockID)
+				delete(self.deletedBlocks, blockID)
+
+			case self.deletedBlocks[blockID]:
+				if !self.deletionIntents.InProgress(blockID) {
+					var deleteFrom []NodeID
+					for n, _ := range nodes {
+						deleteFrom = append(deleteFrom, n)
+					}
+					log.Println("Still deleting block '"+blockID+"' from", deleteFrom)
+					self.deletionIntents.Add(blockID, deleteFrom)
+				}
+
 			case self.replicationIntents.InProgress(blockID):
 				continue
 
 			case self.deletionIntents.InProgress(blockID):
 				continue
 
-			case len(nodes) > self.ReplicationFactor:
+			case len(nodes) > replication:
 				log.Println("Block '" + blockID + "' is over-replicated")
 				var deleteFrom []NodeID
 				nodesByUtilization := self.MostUsedNodes()
 				for _, nodeID := range nodesByUtilization {
-					if len(nodes)-len(deleteFrom) <= self.ReplicationFactor {
+					if len(nodes)-len(deleteFrom) <= replication {
 						break
 					}
 					if nodes[nodeID] {
@@ -265,12 +771,12 @@ func (self *MetaDataNodeState) Monitor() {
 				log.Printf("Deleting from: %v", deleteFrom)
 				self.deletionIntents.Add(blockID, deleteFrom)
 
-			case len(nodes) < self.ReplicationFactor:
+			case len(nodes) < replication:
 				log.Println("Block '" + blockID + "' is under-replicated!")
 				var forwardTo []NodeID
 				nodesByUtilization := self.LeastUsedNodes()
 				for _, nodeID := range nodesByUtilization {
-					if len(forwardTo)+len(nodes) >= self.ReplicationFactor {
+					if len(forwardTo)+len(nodes) >= replication {
 						break
 					}
 					if !nodes[nodeID] {
@@ -286,6 +792,8 @@ func (self *MetaDataNodeState) Monitor() {
 			}
 		}
 
+		self.sweepOrphans()
+
 		if len(self.dataNodes) != 0 {
 			totalUtilization := 0
 			for _, utilization := range self.dataNodesUtilization {
@@ -357,7 +865,7 @@ func (self *MetaDataNodeState) Monitor() {
 			}
 		}
 
+		self.updateWaiting()
 		self.mutex.Unlock()
-		time.Sleep(3 * time.Second)
 	}
 }
@@ -0,0 +1,322 @@
+package metadatanode
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// The schema is built by running these in order. Only ever append to the
+// list: a database's version is how many of them it has had. Databases from
+// before versioning are version 0 whatever their layout, so the first
+// migrations cope with the tables already existing.
+var migrations = []struct {
+	description string
+	apply       func(tx *sql.Tx) error
+}{
+	{"namespace", createNamespace},
+	{"blobs and blob_blocks", createBlobs},
+	{"raft_state and raft_log", createRaft},
+}
+
+// Where the database is copied before an upgrade
+func rollbackFile(filename string) string {
+	return filename + ".rollback"
+}
+
+// Runs the migrations the database hasn't had, all in one transaction
+func migrate(conn *sql.DB, filename string, upgrade bool) error {
+	var tables int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table'").Scan(&tables); err != nil {
+		return err
+	}
+	version, err := schemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version == len(migrations):
+		return nil
+	case version > len(migrations):
+		return fmt.Errorf("Database schema version %d is newer than this MetaDataNode supports (%d)",
+			version, len(migrations))
+	case tables > 0 && !upgrade:
+		return fmt.Errorf("Database schema version %d is out of date, run with -upgrade to migrate it to %d",
+			version, len(migrations))
+	case tables > 0:
+		// Edits SQLite hasn't moved into the file yet would miss the snapshot
+		if _, err := conn.Exec("PRAGMA wal_checkpoint(FULL)"); err != nil {
+			return err
+		}
+		if err := copyFile(filename, rollbackFile(filename)); err != nil {
+			return err
+		}
+		// So would the edit log's, which the upgraded MetaDataNode checkpoints
+		// and empties when it starts
+		if err := os.Remove(editLogFile(rollbackFile(filename))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err := copyFile(editLogFile(filename), editLogFile(rollbackFile(filename)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Println("Saved rollback snapshot at", rollbackFile(filename))
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := version; i < len(migrations); i++ {
+		log.Printf("Migrating database to version %d: %s", i+1, migrations[i].description)
+		if err := migrations[i].apply(tx); err != nil {
+			return fmt.Errorf("Migrating to version %d: %v", i+1, err)
+		}
+	}
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_version(version)"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version VALUES(?)", len(migrations)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 0 for databases from before versioning
+func schemaVersion(q querier) (int, error) {
+	found, err := hasTable(q, "schema_version")
+	if err != nil || !found {
+		return 0, err
+	}
+	var version int
+	err = q.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Puts back the database from before the last upgrade, along with the edits
+// it hadn't checkpointed. The MetaDataNode must not be running.
+func Rollback(filename string) error {
+	if _, err := os.Stat(rollbackFile(filename)); err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("No rollback snapshot for '" + filename + "'")
+		}
+		return err
+	}
+	// Journals and edits left by the upgraded database don't belong to the
+	// snapshot
+	for _, f := range []string{filename + "-journal", filename + "-wal", filename + "-shm", editLogFile(filename)} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(rollbackFile(filename), filename); err != nil {
+		return err
+	}
+	err := os.Rename(editLogFile(rollbackFile(filename)), editLogFile(filename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func createNamespace(tx *sql.Tx) error {
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS namespace(path PRIMARY KEY, parent, dir, blob)"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("CREATE INDEX IF NOT EXISTS namespace_parent ON namespace(parent)")
+	return err
+}
+
+// The Raft log and the node's place in it. Applied is the index of the last
+// edit in the store, and counts edits on MetaDataNodes without Raft too.
+func createRaft(tx *sql.Tx) error {
+	for _, q := range []string{
+		"CREATE TABLE raft_state(term, voted_for, applied, snapshot_index, snapshot_term)",
+		"INSERT INTO raft_state VALUES(0, '', 0, 0, 0)",
+		"CREATE TABLE raft_log(idx INTEGER PRIMARY KEY, term, edit)",
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Times are Unix nanoseconds, NULL for blobs from before they were recorded.
+// State is "open" until the blob is committed.
+const blobsSchema = "CREATE TABLE blobs(id PRIMARY KEY, size, block_size, replication, created, committed, state)"
+const blobBlocksSchema = "CREATE TABLE blob_blocks(blob, idx, block, length, checksum, PRIMARY KEY(blob, idx))"
+
+// Also moves databases from file_blocks, block_sizes and the first blobs
+// table, which only had some of the columns, to blobs and blob_blocks.
+// Blocks were in rowid order.
+func createBlobs(tx *sql.Tx) error {
+	oldBlobs, err := hasTable(tx, "blobs")
+	if err != nil {
+		return err
+	}
+	if oldBlobs {
+		if oldBlobs, err = hasColumn(tx, "blobs", "blob"); err != nil {
+			return err
+		}
+	}
+	fileBlocks, err := hasTable(tx, "file_blocks")
+	if err != nil {
+		return err
+	}
+	if !oldBlobs && !fileBlocks {
+		// Already moved before versioning
+		if found, err := hasTable(tx, "blobs"); err != nil || found {
+			return err
+		}
+		for _, q := range []string{
+			blobsSchema,
+			blobBlocksSchema,
+			"CREATE INDEX blob_blocks_block ON blob_blocks(block)",
+		} {
+			if _, err := tx.Exec(q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	log.Println("Moving blocks from file_blocks to blob_blocks")
+
+	if oldBlobs {
+		if _, err := tx.Exec("ALTER TABLE blobs RENAME TO old_blobs"); err != nil {
+			return err
+		}
+		for _, column := range []string{"block_size", "replication"} {
+			if found, err := hasColumn(tx, "old_blobs", column); err != nil || found {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := tx.Exec("ALTER TABLE old_blobs ADD COLUMN " + column); err != nil {
+				return err
+			}
+		}
+	}
+	for _, q := range []string{
+		blobsSchema,
+		blobBlocksSchema,
+		"CREATE INDEX blob_blocks_block ON blob_blocks(block)",
+		"CREATE TABLE IF NOT EXISTS old_blobs(blob PRIMARY KEY, block_size, replication)",
+		"CREATE TABLE IF NOT EXISTS file_blocks(blob, block)",
+		"CREATE TABLE IF NOT EXISTS block_sizes(block PRIMARY KEY, size)",
+		// Committed blobs used to only be recorded through their blocks
+		"INSERT OR IGNORE INTO old_blobs(blob) SELECT DISTINCT blob FROM file_blocks",
+		"INSERT INTO blobs(id, block_size, replication, state) " +
+			"SELECT blob, block_size, replication, 'committed' FROM old_blobs",
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT file_blocks.blob, file_blocks.block, block_sizes.size FROM file_blocks " +
+		"LEFT JOIN block_sizes ON file_blocks.block = block_sizes.block ORDER BY file_blocks.rowid")
+	if err != nil {
+		return err
+	}
+	type fileBlock struct {
+		blob, block string
+		size        sql.NullInt64
+	}
+	var blocks []fileBlock
+	for rows.Next() {
+		var b fileBlock
+		if err := rows.Scan(&b.blob, &b.block, &b.size); err != nil {
+			rows.Close()
+			return err
+		}
+		blocks = append(blocks, b)
+	}
+	rows.Close()
+	index := map[string]int{}
+	for _, b := range blocks {
+		if _, err := tx.Exec("INSERT INTO blob_blocks VALUES(?, ?, ?, ?, NULL)",
+			b.blob, index[b.blob], b.block, b.size); err != nil {
+			return err
+		}
+		index[b.blob]++
+	}
+
+	for _, q := range []string{
+		"UPDATE blobs SET size=(SELECT IFNULL(SUM(length), 0) FROM blob_blocks WHERE blob=blobs.id)",
+		"DROP TABLE old_blobs",
+		"DROP TABLE file_blocks",
+		"DROP TABLE block_sizes",
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasTable(q querier, table string) (bool, error) {
+	var name string
+	// No errors until Scan, scan requires a location to store the value..
+	err := q.QueryRow(
+		"select name from sqlite_master where type='table' and name=?", table).Scan(&name)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+func hasColumn(q querier, table string, column string) (bool, error) {
+	rows, err := q.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var dflt interface{}
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
@@ -0,0 +1,363 @@
+package metadatanode
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"path"
+	"strings"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Directory tree over blobs. Paths are absolute and cleaned, and "/" always
+// exists without being stored. Every entry records its parent so listing a
+// directory is a single lookup.
+
+// *sql.DB or *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func cleanPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", errors.New("Path must be absolute: '" + p + "'")
+	}
+	return path.Clean(p), nil
+}
+
+// Bounds for selecting everything under a directory: "/" is followed by "0"
+func descendants(p string) (string, string) {
+	if p == "/" {
+		return "/", "0"
+	}
+	return p + "/", p + "0"
+}
+
+func lookup(q querier, p string) (FileInfo, bool, error) {
+	if p == "/" {
+		return FileInfo{Path: "/", IsDir: true}, true, nil
+	}
+	info := FileInfo{Path: p}
+	err := q.QueryRow("SELECT dir, blob FROM namespace WHERE path=?", p).Scan(&info.IsDir, &info.BlobID)
+	switch {
+	case err == sql.ErrNoRows:
+		return FileInfo{}, false, nil
+	case err != nil:
+		return FileInfo{}, false, err
+	}
+	return info, true, nil
+}
+
+func checkParent(q querier, p string) error {
+	parent, found, err := lookup(q, path.Dir(p))
+	switch {
+	case err != nil:
+		return err
+	case !found:
+		return errors.New("No such directory: '" + path.Dir(p) + "'")
+	case !parent.IsDir:
+		return errors.New("Not a directory: '" + path.Dir(p) + "'")
+	}
+	return nil
+}
+
+func (self *DB) Lookup(p string) (FileInfo, bool, error) {
+	return lookup(self.conn, p)
+}
+
+// Errors if the path is taken or its directory doesn't exist
+func (self *DB) CheckCreate(p string) error {
+	return checkCreate(self.conn, p)
+}
+
+func checkCreate(q querier, p string) error {
+	if _, found, err := lookup(q, p); err != nil || found {
+		if found {
+			return errors.New("Already exists: '" + p + "'")
+		}
+		return err
+	}
+	return checkParent(q, p)
+}
+
+func createFile(tx *sql.Tx, p string, blob string) error {
+	if err := checkCreate(tx, p); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO namespace VALUES(?, ?, 0, ?)", p, path.Dir(p), blob)
+	return err
+}
+
+// Creates the directory and any missing parents
+func mkdirs(tx *sql.Tx, p string) error {
+	dir := "/"
+	for _, name := range strings.Split(p, "/")[1:] {
+		if name == "" {
+			continue
+		}
+		dir = path.Join(dir, name)
+		info, found, err := lookup(tx, dir)
+		switch {
+		case err != nil:
+			return err
+		case !found:
+			if _, err := tx.Exec("INSERT INTO namespace VALUES(?, ?, 1, '')", dir, path.Dir(dir)); err != nil {
+				return err
+			}
+		case !info.IsDir:
+			return errors.New("Not a directory: '" + dir + "'")
+		}
+	}
+	return nil
+}
+
+// A directory's children, or a file by itself
+func (self *DB) List(p string) ([]FileInfo, error) {
+	info, found, err := lookup(self.conn, p)
+	switch {
+	case err != nil:
+		return nil, err
+	case !found:
+		return nil, errors.New("No such file or directory: '" + p + "'")
+	case !info.IsDir:
+		return []FileInfo{info}, nil
+	}
+
+	rows, err := self.conn.Query("SELECT path, dir, blob FROM namespace WHERE parent=? ORDER BY path", p)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var children []FileInfo
+	for rows.Next() {
+		var child FileInfo
+		if err := rows.Scan(&child.Path, &child.IsDir, &child.BlobID); err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, rows.Err()
+}
+
+// Moves a file or a whole directory
+func rename(tx *sql.Tx, from string, to string) error {
+	if from == "/" || to == "/" {
+		return errors.New("Can't rename '/'")
+	}
+	if from == to {
+		return nil
+	}
+	if strings.HasPrefix(to, from+"/") {
+		return errors.New("Can't move '" + from + "' inside itself")
+	}
+
+	if _, found, err := lookup(tx, from); err != nil || !found {
+		if err == nil {
+			err = errors.New("No such file or directory: '" + from + "'")
+		}
+		return err
+	}
+	if _, found, err := lookup(tx, to); err != nil || found {
+		if err == nil {
+			err = errors.New("Already exists: '" + to + "'")
+		}
+		return err
+	}
+	if err := checkParent(tx, to); err != nil {
+		return err
+	}
+
+	low, high := descendants(from)
+	rows, err := tx.Query("SELECT path FROM namespace WHERE path >= ? AND path < ?", low, high)
+	if err != nil {
+		return err
+	}
+	var moved []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return err
+		}
+		moved = append(moved, p)
+	}
+	rows.Close()
+
+	for _, p := range moved {
+		newPath := to + strings.TrimPrefix(p, from)
+		if _, err := tx.Exec("UPDATE namespace SET path=?, parent=? WHERE path=?",
+			newPath, path.Dir(newPath), p); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE namespace SET path=?, parent=? WHERE path=?", to, path.Dir(to), from)
+	return err
+}
+
+// Removes an entry, and everything under it if recursive, along with the
+// blobs of the files that were removed. Returns their blocks.
+func deletePath(tx *sql.Tx, p string, recursive bool) ([]string, error) {
+	if p == "/" {
+		return nil, errors.New("Can't delete '/'")
+	}
+	info, found, err := lookup(tx, p)
+	switch {
+	case err != nil:
+		return nil, err
+	case !found:
+		return nil, errors.New("No such file or directory: '" + p + "'")
+	}
+
+	var blobs []string
+	if info.IsDir {
+		low, high := descendants(p)
+		rows, err := tx.Query("SELECT blob FROM namespace WHERE path >= ? AND path < ?", low, high)
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for rows.Next() {
+			var blob string
+			if err := rows.Scan(&blob); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if blob != "" {
+				blobs = append(blobs, blob)
+			}
+			count++
+		}
+		rows.Close()
+		if count > 0 && !recursive {
+			return nil, errors.New("Directory not empty: '" + p + "'")
+		}
+		if _, err := tx.Exec("DELETE FROM namespace WHERE path >= ? AND path < ?", low, high); err != nil {
+			return nil, err
+		}
+	} else {
+		blobs = append(blobs, info.BlobID)
+	}
+	if _, err := tx.Exec("DELETE FROM namespace WHERE path=?", p); err != nil {
+		return nil, err
+	}
+	var blocks []string
+	for _, blob := range blobs {
+		blobBlocks, err := deleteBlob(tx, blob)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, blobBlocks...)
+	}
+	return blocks, nil
+}
+
+// Returns the cleaned path if a blob could be created there
+func (self *MetaDataNodeState) CheckCreate(p string) (string, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return p, self.store.CheckCreate(p)
+}
+
+func (self *MetaDataNodeState) Mkdir(p string) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	_, err = self.propose(Edit{Op: "Mkdir", Path: p})
+	return err
+}
+
+func (self *MetaDataNodeState) List(p string) ([]FileInfo, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	entries, err := self.store.List(p)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if err := self.fillSize(&entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (self *MetaDataNodeState) Stat(p string) (FileInfo, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	info, found, err := self.store.Lookup(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !found {
+		return FileInfo{}, errors.New("No such file or directory: '" + p + "'")
+	}
+	return info, self.fillSize(&info)
+}
+
+func (self *MetaDataNodeState) Rename(from string, to string) error {
+	from, err := cleanPath(from)
+	if err != nil {
+		return err
+	}
+	to, err = cleanPath(to)
+	if err != nil {
+		return err
+	}
+	if !self.owns(PathKey(to)) {
+		return errors.New("Can't move '" + from + "' to '" + to + "', another federated MetaDataNode is in charge of it")
+	}
+	_, err = self.propose(Edit{Op: "Rename", Path: from, To: to})
+	return err
+}
+
+func (self *MetaDataNodeState) Delete(p string, recursive bool) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	blocks, err := self.propose(Edit{Op: "Delete", Path: p, Recursive: recursive})
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, b := range blocks {
+		self.deleteBlock(BlockID(b))
+	}
+	log.Println("Deleted '"+p+"' with", len(blocks), "blocks")
+	return nil
+}
+
+// Must hold mutex
+func (self *MetaDataNodeState) fillSize(info *FileInfo) error {
+	if info.IsDir {
+		return nil
+	}
+	size, err := self.store.BlobSize(info.BlobID)
+	if err != nil {
+		return err
+	}
+	info.Size = size
+	info.BlockSize, info.Replication, err = self.store.BlobSettings(info.BlobID)
+	if info.Replication == 0 {
+		info.Replication = self.ReplicationFactor
+	}
+	return err
+}
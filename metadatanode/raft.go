@@ -0,0 +1,922 @@
+package metadatanode
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// Replicates edits to the other MetaDataNodes with Raft. Each node's store
+// is its state machine. Only the leader serves clients and DataNodes, the
+// others redirect them to it. Uploads that were open and block locations
+// aren't replicated: a new leader forgets open blobs and learns block
+// locations as DataNodes re-register. Once the log has plenty of applied
+// entries, the older ones are dropped, and a follower that needs them gets a
+// copy of the leader's store instead.
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+// Most entries sent to a follower at once
+const maxAppendEntries = 64
+
+var errNotLeader = errors.New(NotLeader)
+
+type LogEntry struct {
+	Term uint64
+	Edit Edit
+}
+
+type RequestVoteMsg struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// Also tells followers where to redirect clients and DataNodes
+type AppendEntriesMsg struct {
+	Term        uint64
+	Leader      string
+	ClientAddr  string
+	ClusterAddr string
+	PrevIndex   uint64
+	PrevTerm    uint64
+	Entries     []LogEntry
+	Commit      uint64
+}
+
+type AppendEntriesResponse struct {
+	Term      uint64
+	Success   bool
+	LastIndex uint64 // So the leader can skip back to it on failure
+}
+
+// Followed by Size bytes of the leader's store, which has applied every entry
+// up to LastIndex, then a Confirm
+type InstallSnapshotMsg struct {
+	Term        uint64
+	Leader      string
+	ClientAddr  string
+	ClusterAddr string
+	LastIndex   uint64
+	LastTerm    uint64
+	Size        int64
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+type editResult struct {
+	result []string
+	err    error
+}
+
+type raft struct {
+	mutex sync.Mutex
+	// Held while the store changes under the log, by applying an entry or
+	// installing a snapshot, and while it's copied for a follower. Taken
+	// before mutex.
+	applying        sync.Mutex
+	addr            string // Raft address, which identifies this node
+	clientAddr      string
+	clusterAddr     string
+	peers           []string
+	store           *DB
+	electionTimeout time.Duration
+	keepEntries     int // Applied entries kept when the log is compacted
+	// Called in their own goroutines when this node wins an election or
+	// stops leading
+	onLeader   func(term uint64)
+	onFollower func()
+
+	role          int
+	term          uint64
+	votedFor      string
+	log           []LogEntry // Entry i has index snapshotIndex+i+1
+	snapshotIndex uint64     // The last entry compacted out of the log
+	snapshotTerm  uint64
+	commitIndex   uint64
+	lastApplied   uint64
+	deadline      time.Time // When to start an election without hearing from a leader
+	ready         bool      // The leader has applied every edit from before its term
+
+	leader        string
+	leaderClient  string
+	leaderCluster string
+
+	// Leader only
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	acked      map[string]time.Time
+	waiting    map[uint64]chan editResult
+
+	applyNotify     chan bool
+	replicateNotify map[string]chan bool
+	stop            chan bool
+	stopped         bool
+	listener        net.Listener
+}
+
+func newRaft(store *DB, listener net.Listener, addr string, clientAddr string, clusterAddr string, peers []string, electionTimeout time.Duration, keepEntries int) (*raft, error) {
+	self := &raft{
+		addr:            addr,
+		clientAddr:      clientAddr,
+		clusterAddr:     clusterAddr,
+		peers:           peers,
+		store:           store,
+		electionTimeout: electionTimeout,
+		keepEntries:     keepEntries,
+		waiting:         map[uint64]chan editResult{},
+		applyNotify:     make(chan bool, 1),
+		replicateNotify: map[string]chan bool{},
+		stop:            make(chan bool),
+		listener:        listener,
+	}
+	for _, peer := range peers {
+		self.replicateNotify[peer] = make(chan bool, 1)
+	}
+
+	var err error
+	if self.term, self.votedFor, err = store.raftState(); err != nil {
+		return nil, err
+	}
+	if self.snapshotIndex, self.snapshotTerm, err = store.raftSnapshot(); err != nil {
+		return nil, err
+	}
+	if self.log, err = store.raftLog(); err != nil {
+		return nil, err
+	}
+	if self.lastApplied, err = store.Applied(); err != nil {
+		return nil, err
+	}
+	self.commitIndex = self.lastApplied
+	self.resetDeadline()
+	return self, nil
+}
+
+func (self *raft) start() {
+	go self.serve()
+	go self.ticker()
+	go self.applier()
+}
+
+func (self *raft) shutdown() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.stopped {
+		return
+	}
+	self.stopped = true
+	self.role = follower
+	self.ready = false
+	self.leaderClient, self.leaderCluster = "", ""
+	close(self.stop)
+	self.listener.Close()
+	self.failWaiting()
+}
+
+// The leader's client and cluster addresses, empty if there isn't one yet,
+// and whether it's this node and ready to serve
+func (self *raft) leaderAddrs() (string, string, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.role == leader {
+		if !self.ready {
+			return "", "", false
+		}
+		return self.clientAddr, self.clusterAddr, true
+	}
+	return self.leaderClient, self.leaderCluster, false
+}
+
+// Once the MetaDataNode has caught up after winning the election
+func (self *raft) setReady(term uint64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.ready = self.role == leader && self.term == term
+}
+
+func (self *raft) isLeader() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.role == leader
+}
+
+// Waits for the edit to be committed and applied here. Only the leader can
+// propose edits.
+func (self *raft) propose(edit Edit) ([]string, error) {
+	self.mutex.Lock()
+	if self.role != leader || self.stopped {
+		self.mutex.Unlock()
+		return nil, errNotLeader
+	}
+	index, _ := self.lastLog()
+	index++
+	entry := LogEntry{self.term, edit}
+	if err := self.store.appendLog(index, []LogEntry{entry}); err != nil {
+		log.Fatalln("Raft log:", err)
+	}
+	self.log = append(self.log, entry)
+	done := make(chan editResult, 1)
+	self.waiting[index] = done
+	for _, notify := range self.replicateNotify {
+		notifyChan(notify)
+	}
+	self.advanceCommit()
+	self.mutex.Unlock()
+
+	result := <-done
+	return result.result, result.err
+}
+
+func notifyChan(c chan bool) {
+	select {
+	case c <- true:
+	default:
+	}
+}
+
+// Must hold mutex
+func (self *raft) resetDeadline() {
+	timeout := self.electionTimeout + time.Duration(rand.Int63n(int64(self.electionTimeout)))
+	self.deadline = time.Now().Add(timeout)
+}
+
+// Must hold mutex
+func (self *raft) lastLog() (uint64, uint64) {
+	if len(self.log) == 0 {
+		return self.snapshotIndex, self.snapshotTerm
+	}
+	return self.snapshotIndex + uint64(len(self.log)), self.log[len(self.log)-1].Term
+}
+
+// Zero for entries past the end or compacted out of the log. Must hold mutex.
+func (self *raft) termAt(index uint64) uint64 {
+	if index == self.snapshotIndex {
+		return self.snapshotTerm
+	}
+	if index < self.snapshotIndex || index > self.snapshotIndex+uint64(len(self.log)) {
+		return 0
+	}
+	return self.log[index-self.snapshotIndex-1].Term
+}
+
+// Must hold mutex
+func (self *raft) majority(count int) bool {
+	return count > (len(self.peers)+1)/2
+}
+
+// Must hold mutex
+func (self *raft) setTerm(term uint64, votedFor string) {
+	self.term = term
+	self.votedFor = votedFor
+	if err := self.store.setRaftState(term, votedFor); err != nil {
+		log.Fatalln("Raft state:", err)
+	}
+}
+
+// Must hold mutex
+func (self *raft) stepDown(term uint64) {
+	if term > self.term {
+		self.setTerm(term, "")
+		self.leader = ""
+		self.leaderClient = ""
+		self.leaderCluster = ""
+	}
+	if self.role == leader {
+		log.Println("No longer leading the MetaDataNodes")
+		self.failWaiting()
+		go self.onFollower()
+	}
+	self.role = follower
+	self.ready = false
+	self.resetDeadline()
+}
+
+// Proposals that haven't been applied may never be. Must hold mutex.
+func (self *raft) failWaiting() {
+	for index, done := range self.waiting {
+		done <- editResult{nil, errNotLeader}
+		delete(self.waiting, index)
+	}
+}
+
+// Starts elections, and makes a leader that can't reach most of the other
+// nodes step down so clients go looking for the new one
+func (self *raft) ticker() {
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-time.After(self.electionTimeout / 10):
+		}
+		self.mutex.Lock()
+		if self.role == leader {
+			heard := 1
+			for _, peer := range self.peers {
+				if time.Since(self.acked[peer]) < self.electionTimeout {
+					heard++
+				}
+			}
+			if !self.majority(heard) {
+				log.Println("Lost touch with the other MetaDataNodes")
+				self.stepDown(self.term)
+			}
+		} else if time.Now().After(self.deadline) {
+			self.startElection()
+		}
+		self.mutex.Unlock()
+	}
+}
+
+// Must hold mutex
+func (self *raft) startElection() {
+	self.role = candidate
+	self.setTerm(self.term+1, self.addr)
+	self.resetDeadline()
+	term := self.term
+	lastIndex, lastTerm := self.lastLog()
+	log.Println("Standing for election in term", term)
+
+	votes := 1
+	if self.majority(votes) {
+		self.becomeLeader()
+		return
+	}
+	for _, peer := range self.peers {
+		go func(peer string) {
+			var resp RequestVoteResponse
+			if err := self.call(peer, "RequestVote", &RequestVoteMsg{term, self.addr, lastIndex, lastTerm}, &resp); err != nil {
+				return
+			}
+			self.mutex.Lock()
+			defer self.mutex.Unlock()
+			if resp.Term > self.term {
+				self.stepDown(resp.Term)
+				return
+			}
+			if self.role != candidate || self.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if self.majority(votes) {
+				self.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// Must hold mutex
+func (self *raft) becomeLeader() {
+	log.Println("Elected leader in term", self.term)
+	self.role = leader
+	self.ready = false
+	self.leader = self.addr
+	self.leaderClient = self.clientAddr
+	self.leaderCluster = self.clusterAddr
+	self.nextIndex = map[string]uint64{}
+	self.matchIndex = map[string]uint64{}
+	self.acked = map[string]time.Time{}
+	lastIndex, _ := self.lastLog()
+	for _, peer := range self.peers {
+		self.nextIndex[peer] = lastIndex + 1
+		self.acked[peer] = time.Now()
+		go self.replicate(peer, self.term)
+	}
+	go self.onLeader(self.term)
+}
+
+// Commits the latest entry from this term that most nodes have. Must hold
+// mutex.
+func (self *raft) advanceCommit() {
+	lastIndex, _ := self.lastLog()
+	for index := lastIndex; index > self.commitIndex; index-- {
+		if self.termAt(index) != self.term {
+			break
+		}
+		count := 1
+		for _, peer := range self.peers {
+			if self.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if self.majority(count) {
+			self.commitIndex = index
+			notifyChan(self.applyNotify)
+			return
+		}
+	}
+}
+
+// Sends entries and heartbeats to one follower while this node leads in term
+func (self *raft) replicate(peer string, term uint64) {
+	for {
+		self.mutex.Lock()
+		if self.stopped || self.role != leader || self.term != term {
+			self.mutex.Unlock()
+			return
+		}
+		if self.nextIndex[peer] <= self.snapshotIndex {
+			self.mutex.Unlock()
+			if self.sendSnapshot(peer, term) {
+				continue
+			}
+			select {
+			case <-self.stop:
+				return
+			case <-time.After(self.electionTimeout / 5):
+			}
+			continue
+		}
+		prevIndex := self.nextIndex[peer] - 1
+		end, _ := self.lastLog()
+		if end > prevIndex+maxAppendEntries {
+			end = prevIndex + maxAppendEntries
+		}
+		entries := self.log[prevIndex-self.snapshotIndex : end-self.snapshotIndex]
+		msg := AppendEntriesMsg{term, self.addr, self.clientAddr, self.clusterAddr,
+			prevIndex, self.termAt(prevIndex), append([]LogEntry{}, entries...), self.commitIndex}
+		self.mutex.Unlock()
+
+		var resp AppendEntriesResponse
+		err := self.call(peer, "AppendEntries", &msg, &resp)
+
+		self.mutex.Lock()
+		behind := false
+		if err == nil && resp.Term > self.term {
+			self.stepDown(resp.Term)
+		} else if err == nil && self.role == leader && self.term == term {
+			self.acked[peer] = time.Now()
+			if resp.Success {
+				match := prevIndex + uint64(len(msg.Entries))
+				if match > self.matchIndex[peer] {
+					self.matchIndex[peer] = match
+				}
+				self.nextIndex[peer] = match + 1
+				self.advanceCommit()
+			} else {
+				next := prevIndex
+				if resp.LastIndex+1 < next {
+					next = resp.LastIndex + 1
+				}
+				if next < 1 {
+					next = 1
+				}
+				self.nextIndex[peer] = next
+			}
+			lastIndex, _ := self.lastLog()
+			behind = self.nextIndex[peer] <= lastIndex
+		}
+		self.mutex.Unlock()
+		if behind {
+			continue
+		}
+
+		select {
+		case <-self.stop:
+			return
+		case <-self.replicateNotify[peer]:
+		case <-time.After(self.electionTimeout / 5):
+		}
+	}
+}
+
+// Applies committed entries to the store in order
+func (self *raft) applier() {
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-self.applyNotify:
+		}
+		for {
+			self.applying.Lock()
+			self.mutex.Lock()
+			if self.lastApplied >= self.commitIndex {
+				self.mutex.Unlock()
+				self.applying.Unlock()
+				break
+			}
+			index := self.lastApplied + 1
+			entry := self.log[index-self.snapshotIndex-1]
+			self.mutex.Unlock()
+
+			result, err := self.store.Apply(index, entry.Edit)
+
+			self.mutex.Lock()
+			self.lastApplied = index
+			if done := self.waiting[index]; done != nil {
+				done <- editResult{result, err}
+				delete(self.waiting, index)
+			}
+			self.compact()
+			self.mutex.Unlock()
+			self.applying.Unlock()
+		}
+	}
+}
+
+// Once the log has twice as many applied entries as it keeps, drops the older
+// ones. Must hold mutex.
+func (self *raft) compact() {
+	if self.lastApplied < self.snapshotIndex+2*uint64(self.keepEntries) {
+		return
+	}
+	index := self.lastApplied - uint64(self.keepEntries)
+	term := self.termAt(index)
+	if err := self.store.compactLog(index, term); err != nil {
+		log.Fatalln("Raft log:", err)
+	}
+	self.log = append([]LogEntry{}, self.log[index-self.snapshotIndex:]...)
+	self.snapshotIndex, self.snapshotTerm = index, term
+}
+
+func (self *raft) requestVote(msg RequestVoteMsg) RequestVoteResponse {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if msg.Term > self.term {
+		self.stepDown(msg.Term)
+	}
+	lastIndex, lastTerm := self.lastLog()
+	upToDate := msg.LastTerm > lastTerm || (msg.LastTerm == lastTerm && msg.LastIndex >= lastIndex)
+	if msg.Term == self.term && upToDate && (self.votedFor == "" || self.votedFor == msg.Candidate) {
+		self.setTerm(self.term, msg.Candidate)
+		self.resetDeadline()
+		return RequestVoteResponse{self.term, true}
+	}
+	return RequestVoteResponse{self.term, false}
+}
+
+func (self *raft) appendEntries(msg AppendEntriesMsg) AppendEntriesResponse {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	lastIndex, _ := self.lastLog()
+	if msg.Term < self.term {
+		return AppendEntriesResponse{self.term, false, lastIndex}
+	}
+	self.heardFromLeader(msg.Term, msg.Leader, msg.ClientAddr, msg.ClusterAddr)
+
+	// Entries up to the snapshot were committed, so they match the leader's
+	prevIndex, prevTerm, entries := msg.PrevIndex, msg.PrevTerm, msg.Entries
+	if prevIndex < self.snapshotIndex {
+		skip := self.snapshotIndex - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		prevIndex += skip
+		prevTerm = self.termAt(prevIndex)
+		entries = entries[skip:]
+	}
+	if prevIndex > lastIndex || self.termAt(prevIndex) != prevTerm {
+		last := lastIndex
+		if prevIndex <= last {
+			last = prevIndex - 1
+		}
+		return AppendEntriesResponse{self.term, false, last}
+	}
+	for i, entry := range entries {
+		index := prevIndex + uint64(i) + 1
+		if index <= lastIndex && self.termAt(index) == entry.Term {
+			continue
+		}
+		// Anything from here on that differs was never committed
+		if err := self.store.appendLog(index, entries[i:]); err != nil {
+			log.Fatalln("Raft log:", err)
+		}
+		self.log = append(self.log[:index-self.snapshotIndex-1], entries[i:]...)
+		break
+	}
+	if msg.Commit > self.commitIndex {
+		self.commitIndex = msg.Commit
+		if last := msg.PrevIndex + uint64(len(msg.Entries)); last < self.commitIndex {
+			self.commitIndex = last
+		}
+		notifyChan(self.applyNotify)
+	}
+	lastIndex, _ = self.lastLog()
+	return AppendEntriesResponse{self.term, true, lastIndex}
+}
+
+// Must hold mutex
+func (self *raft) heardFromLeader(term uint64, leader string, clientAddr string, clusterAddr string) {
+	if term > self.term || self.role != follower {
+		self.stepDown(term)
+	}
+	self.leader = leader
+	self.leaderClient = clientAddr
+	self.leaderCluster = clusterAddr
+	self.resetDeadline()
+}
+
+// Sends a copy of the store to a follower that needs entries compacted out of
+// the log. Returns whether the follower has it.
+func (self *raft) sendSnapshot(peer string, term uint64) bool {
+	conn, err := net.DialTimeout("tcp", peer, self.electionTimeout/2)
+	if err != nil {
+		return false
+	}
+	client := NewRPCClient(conn)
+	defer client.Close()
+	tmp, err := ioutil.TempFile("", "raft-snapshot-")
+	if err != nil {
+		log.Println("Raft snapshot:", err)
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	self.applying.Lock()
+	err = self.store.Backup(tmp.Name())
+	self.mutex.Lock()
+	index := self.lastApplied
+	lastTerm := self.termAt(index)
+	self.mutex.Unlock()
+	self.applying.Unlock()
+	if err != nil {
+		log.Println("Raft snapshot:", err)
+		return false
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		log.Println("Raft snapshot:", err)
+		return false
+	}
+
+	log.Println("Sending a snapshot up to", index, "to", peer)
+	// The copy can take a while
+	conn.SetDeadline(time.Now().Add(10 * self.electionTimeout))
+	msg := InstallSnapshotMsg{term, self.addr, self.clientAddr, self.clusterAddr, index, lastTerm, info.Size()}
+	var resp InstallSnapshotResponse
+	err = client.Call("InstallSnapshot", &msg, &resp)
+	if err == nil && resp.Term <= term {
+		if _, err = io.CopyN(client, tmp, msg.Size); err == nil {
+			err = client.Call("Confirm", nil, &resp)
+		}
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if resp.Term > self.term {
+		self.stepDown(resp.Term)
+		return false
+	}
+	if err != nil {
+		log.Println("Raft snapshot:", err)
+		return false
+	}
+	if self.role != leader || self.term != term {
+		return false
+	}
+	self.acked[peer] = time.Now()
+	if index > self.matchIndex[peer] {
+		self.matchIndex[peer] = index
+	}
+	self.nextIndex[peer] = index + 1
+	return true
+}
+
+// Receives the snapshot that follows msg, and replaces the store with it
+func (self *raft) receiveSnapshot(c net.Conn, server *RPCServer, msg InstallSnapshotMsg) {
+	self.mutex.Lock()
+	if msg.Term >= self.term {
+		self.heardFromLeader(msg.Term, msg.Leader, msg.ClientAddr, msg.ClusterAddr)
+	}
+	resp := InstallSnapshotResponse{self.term}
+	self.mutex.Unlock()
+	server.Send(&resp)
+	if msg.Term < resp.Term {
+		return
+	}
+
+	tmp, err := ioutil.TempFile("", "raft-snapshot-")
+	if err != nil {
+		log.Println("Raft snapshot:", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.CopyN(tmp, c, msg.Size); err != nil {
+		log.Println("Raft snapshot:", err)
+		return
+	}
+	if method, err := server.ReadHeader(); err != nil || method != "Confirm" {
+		log.Println("Raft snapshot wasn't confirmed:", method, err)
+		return
+	}
+	server.ReadBody(nil)
+
+	if err := self.installSnapshot(msg, tmp.Name()); err != nil {
+		log.Println("Raft snapshot:", err)
+		server.Error(err.Error())
+		return
+	}
+	server.Send(&resp)
+}
+
+func (self *raft) installSnapshot(msg InstallSnapshotMsg, filename string) error {
+	self.applying.Lock()
+	defer self.applying.Unlock()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if msg.Term < self.term {
+		return errors.New("Snapshot from an old term")
+	}
+	if msg.LastIndex <= self.lastApplied {
+		return nil
+	}
+	if err := self.store.installSnapshot(filename, self.term, self.votedFor, msg.LastIndex, msg.LastTerm); err != nil {
+		return err
+	}
+	log.Println("Installed a snapshot up to", msg.LastIndex)
+	// Anything committed after the snapshot will come again
+	self.log = nil
+	self.snapshotIndex, self.snapshotTerm = msg.LastIndex, msg.LastTerm
+	self.lastApplied = msg.LastIndex
+	self.commitIndex = msg.LastIndex
+	return nil
+}
+
+func (self *raft) call(peer string, method string, args interface{}, reply interface{}) error {
+	conn, err := net.DialTimeout("tcp", peer, self.electionTimeout/2)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(self.electionTimeout))
+	client := NewRPCClient(conn)
+	defer client.Close()
+	return client.Call(method, args, reply)
+}
+
+func (self *raft) serve() {
+	for {
+		peer, err := self.listener.Accept()
+		if err != nil {
+			select {
+			case <-self.stop:
+				return
+			default:
+				log.Fatal(err)
+			}
+		}
+		go self.runRaftRPC(peer)
+	}
+}
+
+func (self *raft) runRaftRPC(c net.Conn) {
+	server := NewRPCServer(c)
+	defer c.Close()
+
+	method, err := server.ReadHeader()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	switch method {
+	case "RequestVote":
+		var msg RequestVoteMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		resp := self.requestVote(msg)
+		server.Send(&resp)
+
+	case "AppendEntries":
+		var msg AppendEntriesMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		resp := self.appendEntries(msg)
+		server.Send(&resp)
+
+	case "InstallSnapshot":
+		var msg InstallSnapshotMsg
+		if err := server.ReadBody(&msg); err != nil {
+			log.Println(err)
+			return
+		}
+		self.receiveSnapshot(c, server, msg)
+
+	default:
+		log.Println("Unacceptable:", method)
+		server.Unacceptable()
+	}
+}
+
+func (self *DB) raftState() (uint64, string, error) {
+	var term uint64
+	var votedFor string
+	err := self.conn.QueryRow("SELECT term, voted_for FROM raft_state").Scan(&term, &votedFor)
+	return term, votedFor, err
+}
+
+// The index and term of the last entry compacted out of the log
+func (self *DB) raftSnapshot() (uint64, uint64, error) {
+	var index, term uint64
+	err := self.conn.QueryRow("SELECT snapshot_index, snapshot_term FROM raft_state").Scan(&index, &term)
+	return index, term, err
+}
+
+func (self *DB) compactLog(index uint64, term uint64) error {
+	tx, err := self.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM raft_log WHERE idx <= ?", index); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE raft_state SET snapshot_index=?, snapshot_term=?", index, term); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Replaces the database with a leader's copy of its own, keeping this node's
+// term and vote, and without the leader's log
+func (self *DB) installSnapshot(filename string, term uint64, votedFor string, index uint64, lastTerm uint64) error {
+	snapshot, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	if _, err := snapshot.Exec("UPDATE raft_state SET term=?, voted_for=?, applied=?, snapshot_index=?, snapshot_term=?",
+		term, votedFor, index, index, lastTerm); err != nil {
+		return err
+	}
+	if _, err := snapshot.Exec("DELETE FROM raft_log"); err != nil {
+		return err
+	}
+	return copyDatabase(self.conn, snapshot)
+}
+
+func (self *DB) setRaftState(term uint64, votedFor string) error {
+	_, err := self.conn.Exec("UPDATE raft_state SET term=?, voted_for=?", term, votedFor)
+	return err
+}
+
+func (self *DB) raftLog() ([]LogEntry, error) {
+	rows, err := self.conn.Query("SELECT term, edit FROM raft_log ORDER BY idx")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []LogEntry
+	for rows.Next() {
+		var entry LogEntry
+		var edit []byte
+		if err := rows.Scan(&entry.Term, &edit); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(edit, &entry.Edit); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Replaces the log from index on
+func (self *DB) appendLog(index uint64, entries []LogEntry) error {
+	tx, err := self.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM raft_log WHERE idx >= ?", index); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		edit, err := json.Marshal(&entry.Edit)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO raft_log VALUES(?, ?, ?)", index+uint64(i), entry.Term, edit); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,318 @@
+package metadatanode
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// A standby copies every edit the primary makes, as the primary makes it,
+// and hears from DataNodes like the primary does, so it knows where blocks
+// are. It doesn't serve clients or tell DataNodes to do anything until it's
+// promoted. Edits are copied after the primary has made them, so the last
+// few can be missing from a standby when the primary dies.
+
+// Edits a standby can fall behind by before the primary drops it, and it
+// has to catch up again
+const standbyBacklog = 1000
+
+// Sent to the primary's cluster port. The primary sends every edit after
+// After, or a copy of its store first if it doesn't have them all anymore
+// or Snapshot is set.
+type TailEditsMsg struct {
+	After    uint64
+	Snapshot bool
+}
+
+// Followed by Size bytes of the primary's store, which has every edit up to
+// Index, then each edit after that as it's made
+type TailEditsResponse struct {
+	ClientAddr string
+	Index      uint64
+	Size       int64
+}
+
+type standby struct {
+	primary       string // Cluster address
+	primaryClient string // Where clients are sent, once the primary says
+	synced        bool   // Has a copy of the primary's store
+	conn          net.Conn
+}
+
+func (self *MetaDataNodeState) isStandby() bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.standby != nil
+}
+
+// Sends the standby on c every edit after msg.After, until it can't keep up
+// or goes away
+func (self *MetaDataNodeState) tailEdits(c net.Conn, server *RPCServer, msg TailEditsMsg) {
+	self.mutex.Lock()
+	if self.raft != nil || self.standby != nil {
+		self.mutex.Unlock()
+		server.Error("Only a primary MetaDataNode has standbys")
+		return
+	}
+	resp := TailEditsResponse{self.clientAddr, msg.After, 0}
+	backlog, ok := self.editsAfter(msg.After)
+	var snapshot *os.File
+	if msg.Snapshot || !ok {
+		backlog = nil
+		var err error
+		if snapshot, err = ioutil.TempFile("", "standby-snapshot-"); err == nil {
+			defer os.Remove(snapshot.Name())
+			defer snapshot.Close()
+			err = self.store.Backup(snapshot.Name())
+		}
+		if err == nil {
+			var info os.FileInfo
+			info, err = snapshot.Stat()
+			resp.Index, resp.Size = self.applied, info.Size()
+		}
+		if err != nil {
+			self.mutex.Unlock()
+			log.Println("Standby snapshot:", err)
+			server.Error(err.Error())
+			return
+		}
+	}
+	// Registered in the same critical section as the snapshot or backlog is
+	// taken, so no edit falls between them
+	edits := make(chan loggedEdit, standbyBacklog)
+	self.standbys[edits] = true
+	self.mutex.Unlock()
+	defer self.dropStandby(edits)
+
+	log.Println("Standby at", c.RemoteAddr(), "is tailing edits after", resp.Index)
+	if err := server.Send(&resp); err != nil {
+		log.Println("Standby:", err)
+		return
+	}
+	if snapshot != nil {
+		if _, err := io.Copy(c, snapshot); err != nil {
+			log.Println("Standby snapshot:", err)
+			return
+		}
+	}
+	encoder := json.NewEncoder(c)
+	for _, e := range backlog {
+		if err := encoder.Encode(&e); err != nil {
+			log.Println("Standby:", err)
+			return
+		}
+	}
+	for e := range edits {
+		if err := encoder.Encode(&e); err != nil {
+			log.Println("Standby:", err)
+			return
+		}
+	}
+	log.Println("Stopped sending edits to the standby at", c.RemoteAddr())
+}
+
+func (self *MetaDataNodeState) dropStandby(edits chan loggedEdit) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.standbys[edits] {
+		delete(self.standbys, edits)
+		close(edits)
+	}
+}
+
+// Passes an edit that was just made on to the standbys. One that's too far
+// behind is dropped rather than holding up edits. Must hold mutex.
+func (self *MetaDataNodeState) sendToStandbys(e loggedEdit) {
+	for edits := range self.standbys {
+		select {
+		case edits <- e:
+		default:
+			delete(self.standbys, edits)
+			close(edits)
+		}
+	}
+}
+
+// The edits after index, if the edit log still has all of them. Must hold
+// mutex.
+func (self *MetaDataNodeState) editsAfter(index uint64) ([]loggedEdit, bool) {
+	if index == self.applied {
+		return nil, true
+	}
+	edits := self.editLog.edits
+	if index > self.applied || len(edits) == 0 || edits[0].Index > index+1 {
+		return nil, false
+	}
+	return append([]loggedEdit{}, edits[index+1-edits[0].Index:]...), true
+}
+
+// Copies the primary's edits until promoted or stopped, reconnecting when it
+// loses the primary
+func (self *MetaDataNodeState) tailPrimary() {
+	for !self.isStopped() && self.isStandby() {
+		if err := self.tailOnce(); err != nil && self.isStandby() {
+			log.Println("Tailing the primary:", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (self *MetaDataNodeState) tailOnce() error {
+	self.mutex.Lock()
+	if self.standby == nil || self.stopped {
+		self.mutex.Unlock()
+		return nil
+	}
+	primary := self.standby.primary
+	// Whatever was in the database before the first copy of the primary's
+	// store could be from anywhere
+	msg := TailEditsMsg{self.applied, !self.standby.synced}
+	self.mutex.Unlock()
+
+	conn, err := net.DialTimeout("tcp", primary, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !self.setStandbyConn(conn) {
+		return nil
+	}
+	client := NewRPCClient(conn)
+	var resp TailEditsResponse
+	if err := client.Call("TailEdits", &msg, &resp); err != nil {
+		return err
+	}
+	reader := client.Reader()
+	self.mutex.Lock()
+	if self.standby != nil {
+		self.standby.primaryClient = resp.ClientAddr
+	}
+	self.mutex.Unlock()
+
+	if resp.Size > 0 {
+		if err := self.receiveStandbySnapshot(reader, resp); err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var e loggedEdit
+		if err := decoder.Decode(&e); err != nil {
+			return err
+		}
+		if done, err := self.applyPrimaryEdit(e); done || err != nil {
+			return err
+		}
+	}
+}
+
+// Whether it's still a standby to use the connection for
+func (self *MetaDataNodeState) setStandbyConn(conn net.Conn) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.standby == nil || self.stopped {
+		return false
+	}
+	self.standby.conn = conn
+	return true
+}
+
+// Returns true once promoted
+func (self *MetaDataNodeState) applyPrimaryEdit(e loggedEdit) (bool, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.standby == nil || self.stopped {
+		return true, nil
+	}
+	if e.Index != self.applied+1 {
+		return false, fmt.Errorf("Primary skipped from edit %d to %d", self.applied, e.Index)
+	}
+	self.edit(e.Edit)
+	return false, nil
+}
+
+// Replaces the store with the primary's copy of its own
+func (self *MetaDataNodeState) receiveStandbySnapshot(r io.Reader, resp TailEditsResponse) error {
+	tmp, err := ioutil.TempFile("", "standby-snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	n, err := io.CopyN(tmp, r, resp.Size)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.standby == nil || self.stopped {
+		return nil
+	}
+	// Its edits are older than the snapshot, or weren't the primary's
+	if err := self.editLog.truncate(); err != nil {
+		log.Fatalln("Edit log:", err)
+	}
+	if err := self.store.replaceWith(tmp.Name()); err != nil {
+		return err
+	}
+	if self.applied, err = self.store.Applied(); err != nil {
+		log.Fatalln("Metadata store error:", err)
+	}
+	if self.applied != resp.Index {
+		log.Fatalln("The primary's snapshot has edits up to", self.applied, "not", resp.Index)
+	}
+	self.checkpoint()
+	self.standby.synced = true
+	log.Println("Copied", n, "bytes of the primary's metadata, up to edit", self.applied)
+	return nil
+}
+
+// Stops following the primary and takes over from it, with the edits and
+// block locations it has. The primary has to be gone first, or both of them
+// will be telling DataNodes what to do.
+func (self *MetaDataNodeState) Promote() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	switch {
+	case self.standby == nil:
+		return errors.New("Not a standby")
+	case !self.standby.synced:
+		return errors.New("Hasn't copied the primary's metadata yet")
+	}
+	if self.standby.conn != nil {
+		self.standby.conn.Close()
+	}
+	self.standby = nil
+
+	if _, err := self.edit(Edit{Op: "ForgetOpenBlobs"}); err != nil {
+		log.Fatalln("Metadata store error:", err)
+	}
+	replication, err := self.store.Replication()
+	if err != nil {
+		log.Fatalln("Metadata store error:", err)
+	}
+	self.blobReplication = replication
+	log.Println("Promoted to primary at edit", self.applied)
+	return nil
+}
+
+// Replaces the database with a copy of another one
+func (self *DB) replaceWith(filename string) error {
+	src, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return copyDatabase(self.conn, src)
+}
@@ -1,59 +1,272 @@
 package metadatanode
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"time"
 
-	_ "golang-distributed-filesystem/3rdparty/github.com/mattn/go-sqlite3"
+	"golang-distributed-filesystem/3rdparty/github.com/mattn/go-sqlite3"
+
+	. "golang-distributed-filesystem/common"
 )
 
 type DB struct {
 	conn *sql.DB
 }
 
-func OpenDB(filename string) (*DB, error) {
+// Brings the schema up to date if it's new. An existing database that's out
+// of date is only migrated with upgrade, after it's been copied to the
+// rollback snapshot.
+func OpenDB(filename string, upgrade bool) (*DB, error) {
 	conn, err := sql.Open("sqlite3", filename)
 	if err != nil {
 		return nil, err
 	}
-	var name string
-	// No errors until Scan, scan requires a location to store the value..
-	err = conn.QueryRow(
-		"select name from sqlite_master where type='table' and name='file_blocks'").Scan(&name)
-	switch {
-	case err == sql.ErrNoRows:
-		if _, err = conn.Exec("CREATE TABLE file_blocks(blob, block)"); err != nil {
-			log.Fatalln(err)
-		}
-	case err != nil:
-		log.Fatalln(err)
-	default:
+	// Edits and the Raft log are written from different goroutines, and
+	// SQLite doesn't wait for a lock held by another connection's transaction
+	conn.SetMaxOpenConns(1)
+	if err := migrate(conn, filename, upgrade); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &DB{conn}, nil
+}
+
+func (self *DB) Close() error {
+	return self.conn.Close()
+}
+
+// Copies the database to filename with SQLite's online backup. The copy
+// restarts if another connection writes while it's going, so callers should
+// hold off writes.
+func (self *DB) Backup(filename string) error {
+	dest, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
 	}
+	defer dest.Close()
+	return copyDatabase(dest, self.conn)
+}
 
-	return &DB{conn}, err
+func copyDatabase(dest *sql.DB, src *sql.DB) error {
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			backup, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := backup.Step(-1)
+				if err != nil {
+					backup.Close()
+					return err
+				}
+				if done {
+					return backup.Close()
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	})
 }
 
-// This is not concurrency-safe since SQLite3 is not
-func (self *DB) Append(key, value string) error {
-	_, err := self.conn.Exec("INSERT INTO file_blocks VALUES(?, ?)", key, value)
+// Uploads don't survive a restart or a new leader, their blocks are swept
+// up as orphans
+func forgetOpenBlobs(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM blobs WHERE state='open'")
 	return err
 }
 
+func createBlob(tx *sql.Tx, key string, blockSize int64, replication int, created time.Time) error {
+	_, err := tx.Exec("INSERT INTO blobs VALUES(?, 0, ?, ?, ?, NULL, 'open')",
+		key, blockSize, replication, created.UnixNano())
+	return err
+}
+
+func abandonBlob(tx *sql.Tx, key string) error {
+	_, err := tx.Exec("DELETE FROM blobs WHERE id=? AND state='open'", key)
+	return err
+}
+
+// Records the blocks in order
+func commitBlob(tx *sql.Tx, key string, blocks []BlockInfo, committed time.Time) error {
+	var size int64
+	for i, b := range blocks {
+		if _, err := tx.Exec("INSERT INTO blob_blocks VALUES(?, ?, ?, ?, ?)",
+			key, i, string(b.BlockID), b.Size, b.Checksum); err != nil {
+			return err
+		}
+		size += b.Size
+	}
+	result, err := tx.Exec("UPDATE blobs SET size=?, committed=?, state='committed' WHERE id=? AND state='open'",
+		size, committed.UnixNano(), key)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		if err == nil {
+			err = errors.New("Blob isn't open: '" + key + "'")
+		}
+		return err
+	}
+	return nil
+}
+
+// Blocks of a blob in order
 func (self *DB) Get(key string) ([]string, error) {
-	rows, err := self.conn.Query("SELECT block FROM file_blocks WHERE blob=?", key)
+	return getBlockIDs(self.conn, key)
+}
+
+func getBlockIDs(q querier, key string) ([]string, error) {
+	blocks, err := getBlocks(q, key)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, b := range blocks {
+		names = append(names, string(b.BlockID))
+	}
+	return names, nil
+}
+
+// Blocks of a blob in order, with size -1 where it was never recorded
+func (self *DB) GetBlocks(key string) ([]BlockInfo, error) {
+	return getBlocks(self.conn, key)
+}
+
+func getBlocks(q querier, key string) ([]BlockInfo, error) {
+	rows, err := q.Query(
+		"SELECT block, IFNULL(length, -1), IFNULL(checksum, '') FROM blob_blocks WHERE blob=? ORDER BY idx", key)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var blocks []string
+	var blocks []BlockInfo
 	for rows.Next() {
-		var b string
-		err = rows.Scan(&b)
-		if err != nil {
+		var b BlockInfo
+		if err = rows.Scan(&b.BlockID, &b.Size, &b.Checksum); err != nil {
 			return nil, err
 		}
 		blocks = append(blocks, b)
 	}
 
+	return blocks, rows.Err()
+}
+
+// Sum of the recorded block sizes
+func (self *DB) BlobSize(key string) (int64, error) {
+	var size int64
+	err := self.conn.QueryRow("SELECT IFNULL(size, 0) FROM blobs WHERE id=?", key).Scan(&size)
+	return size, err
+}
+
+// Block size and replication factor, 0 for blobs from before they were
+// recorded
+func (self *DB) BlobSettings(key string) (int64, int, error) {
+	var blockSize int64
+	var replication int
+	err := self.conn.QueryRow("SELECT IFNULL(block_size, 0), IFNULL(replication, 0) FROM blobs WHERE id=?",
+		key).Scan(&blockSize, &replication)
+	return blockSize, replication, err
+}
+
+// Everything but the blocks. Zero times weren't recorded.
+func (self *DB) StatBlob(key string) (BlobInfo, error) {
+	info := BlobInfo{BlobID: key}
+	var created, committed int64
+	err := self.conn.QueryRow(
+		"SELECT IFNULL(size, 0), IFNULL(block_size, 0), IFNULL(replication, 0), "+
+			"IFNULL(created, 0), IFNULL(committed, 0), state FROM blobs WHERE id=?", key).Scan(
+		&info.Size, &info.BlockSize, &info.Replication, &created, &committed, &info.State)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if created != 0 {
+		info.Created = time.Unix(0, created)
+	}
+	if committed != 0 {
+		info.Committed = time.Unix(0, committed)
+	}
+	return info, nil
+}
+
+func setReplication(tx *sql.Tx, key string, replication int) error {
+	_, err := tx.Exec("UPDATE blobs SET replication=? WHERE id=?", replication, key)
+	return err
+}
+
+// Every blob that has its own replication factor
+func (self *DB) Replication() (map[string]int, error) {
+	rows, err := self.conn.Query("SELECT id, replication FROM blobs WHERE replication > 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	replication := map[string]int{}
+	for rows.Next() {
+		var blob string
+		var n int
+		if err := rows.Scan(&blob, &n); err != nil {
+			return nil, err
+		}
+		replication[blob] = n
+	}
+	return replication, rows.Err()
+}
+
+// Only committed blobs
+func (self *DB) HasBlob(key string) (bool, error) {
+	var blob string
+	err := self.conn.QueryRow("SELECT id FROM blobs WHERE id=? AND state='committed'", key).Scan(&blob)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// Forgets the blob and any paths to it. Returns its blocks.
+func deleteBlob(tx *sql.Tx, key string) ([]string, error) {
+	blocks, err := getBlockIDs(tx, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range []string{
+		"DELETE FROM blob_blocks WHERE blob=?",
+		"DELETE FROM blobs WHERE id=?",
+		"DELETE FROM namespace WHERE blob=?",
+	} {
+		if _, err := tx.Exec(q, key); err != nil {
+			return nil, err
+		}
+	}
 	return blocks, nil
 }
+
+// Whether a committed blob uses the block
+func (self *DB) HasBlock(block string) (bool, error) {
+	var blob string
+	err := self.conn.QueryRow("SELECT blob FROM blob_blocks WHERE block=?", block).Scan(&blob)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
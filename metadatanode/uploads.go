@@ -0,0 +1,365 @@
+package metadatanode
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"golang-distributed-filesystem/3rdparty/github.com/nu7hatch/gouuid"
+
+	. "golang-distributed-filesystem/common"
+)
+
+// How long a DataNode that a client couldn't reach is picked last for new
+// blocks
+const demotionPeriod = time.Minute
+
+// A blob that's being written. Its blocks aren't in the store until it's
+// committed, so this is the only record of them.
+type openBlob struct {
+	path        string
+	blockSize   int64
+	replication int
+	blocks      []BlockID
+	acked       []BlockInfo                 // In the order they were written
+	assigned    map[BlockID]map[NodeID]bool // Every DataNode in a block's pipelines
+	wanted      map[BlockID]int             // Length of a block's latest pipeline
+	replicas    map[BlockID]int             // DataNodes that confirmed an acked block
+	token       string
+	expires     time.Time
+	resumeToken string
+}
+
+// A block size or replication factor of 0 is the cluster default
+func (self *MetaDataNodeState) CreateBlob(path string, blockSize int64, replication int) (Lease, error) {
+	switch {
+	case blockSize == 0:
+		blockSize = self.blockSize
+	case blockSize < self.minBlockSize || blockSize > self.maxBlockSize:
+		return Lease{}, fmt.Errorf("Block size must be between %d and %d", self.minBlockSize, self.maxBlockSize)
+	}
+	switch {
+	case replication == 0:
+		replication = self.ReplicationFactor
+	case replication < 0:
+		return Lease{}, errors.New("Replication factor must be at least 1")
+	}
+	blobID := self.GenerateBlobId()
+	lease := Lease{blobID, newToken(), time.Now().Add(self.leaseDuration), newToken()}
+
+	edit := Edit{Op: "CreateBlob", BlobID: blobID, BlockSize: blockSize, Replication: replication, Time: time.Now()}
+	if _, err := self.propose(edit); err != nil {
+		return Lease{}, err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.openBlobs[blobID] = &openBlob{path, blockSize, replication, nil, nil, map[BlockID]map[NodeID]bool{}, map[BlockID]int{}, map[BlockID]int{}, lease.Token, lease.Expires, lease.ResumeToken}
+	return lease, nil
+}
+
+func newToken() string {
+	u4, err := uuid.NewV4()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return u4.String()
+}
+
+// Must hold mutex
+func (self *MetaDataNodeState) checkLease(blobID string, token string) (*openBlob, error) {
+	open := self.openBlobs[blobID]
+	switch {
+	case open == nil:
+		return nil, errors.New("Blob isn't open: '" + blobID + "'")
+	case open.token != token:
+		return nil, errors.New("Wrong lease token for blob '" + blobID + "'")
+	case time.Now().After(open.expires):
+		return nil, errors.New("Lease on blob '" + blobID + "' expired")
+	}
+	return open, nil
+}
+
+func (self *MetaDataNodeState) Append(blobID string, token string) (ForwardBlock, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	open, err := self.checkLease(blobID, token)
+	if err != nil {
+		return ForwardBlock{}, err
+	}
+	block := self.generateBlock(blobID)
+	open.blocks = append(open.blocks, block.BlockID)
+	return block, nil
+}
+
+// A new pipeline for a block whose DataNodes the client couldn't reach. The
+// unreachable nodes are picked last for a while, as long as they were in one
+// of the block's pipelines. A node that's already demoted stays demoted
+// until its demotion runs out, rather than a client keeping it down. The
+// pipeline only has enough nodes to make up for the ones that failed, the
+// kept ones aren't sent the block again.
+func (self *MetaDataNodeState) ReplaceTargets(blobID string, token string, blockID BlockID, excluded []string, kept []string) (ForwardBlock, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	open, err := self.checkLease(blobID, token)
+	if err != nil {
+		return ForwardBlock{}, err
+	}
+	appended := false
+	for _, b := range open.blocks {
+		appended = appended || b == blockID
+	}
+	if !appended {
+		return ForwardBlock{}, errors.New("Block '" + string(blockID) + "' wasn't appended to blob '" + blobID + "'")
+	}
+
+	skip := map[NodeID]bool{}
+	var keep []NodeID
+	for nodeID, addr := range self.dataNodes {
+		for _, k := range kept {
+			if addr == k && open.assigned[blockID][nodeID] {
+				keep = append(keep, nodeID)
+			}
+		}
+		for _, e := range excluded {
+			if addr != e || !open.assigned[blockID][nodeID] {
+				continue
+			}
+			skip[nodeID] = true
+			if self.demoted(nodeID) == 0 {
+				log.Println("Demoting", nodeID, "since a client couldn't reach it")
+				self.dataNodesDemoted[nodeID] = time.Now()
+			}
+		}
+	}
+	self.replicationIntents.Forget(blockID)
+	block := self.pipeline(blockID, open, skip, keep)
+	if len(block.Nodes) == 0 {
+		return ForwardBlock{}, errors.New("No DataNodes left to try")
+	}
+	return block, nil
+}
+
+// Returns the new expiry
+func (self *MetaDataNodeState) RenewLease(blobID string, token string) (time.Time, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	open, err := self.checkLease(blobID, token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	open.expires = time.Now().Add(self.leaseDuration)
+	return open.expires, nil
+}
+
+// The replicas are recorded right away rather than on their next heartbeat,
+// so the blob can be read as soon as it's committed. Acking a block again the
+// same way does nothing, so a client can retry when the reply was lost.
+func (self *MetaDataNodeState) AckBlock(blobID string, token string, block BlockInfo, replicas []string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	open, err := self.checkLease(blobID, token)
+	if err != nil {
+		return err
+	}
+	for _, a := range open.acked {
+		if a.BlockID == block.BlockID {
+			if a != block {
+				return errors.New("Block '" + string(block.BlockID) + "' was already acked with a different size")
+			}
+			return nil
+		}
+	}
+	for _, b := range open.blocks {
+		if b == block.BlockID {
+			open.acked = append(open.acked, block)
+			for nodeID, addr := range self.dataNodes {
+				for _, r := range replicas {
+					if addr == r {
+						self.hasBlocks(nodeID, []BlockID{block.BlockID})
+						open.replicas[block.BlockID]++
+						break
+					}
+				}
+			}
+			return nil
+		}
+	}
+	return errors.New("Block '" + string(block.BlockID) + "' wasn't appended to blob '" + blobID + "'")
+}
+
+// Takes over an upload from a client that went away, given the resume token
+// the blob was created with. The old lease stops working.
+func (self *MetaDataNodeState) ResumeBlob(blobID string, resumeToken string) (ResumeResponse, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	open := self.openBlobs[blobID]
+	switch {
+	case open == nil:
+		return ResumeResponse{}, errors.New("Blob isn't open: '" + blobID + "'")
+	case open.resumeToken != resumeToken:
+		return ResumeResponse{}, errors.New("Wrong resume token for blob '" + blobID + "'")
+	}
+	open.token = newToken()
+	open.expires = time.Now().Add(self.leaseDuration)
+	lease := Lease{blobID, open.token, open.expires, open.resumeToken}
+	return ResumeResponse{lease, append([]BlockInfo{}, open.acked...)}, nil
+}
+
+// Links the blob at its path too, if it was created with one. Every block
+// has to be on as many DataNodes as its pipeline had, so the data is durable
+// once this returns. Committing the same blocks again succeeds, so a client
+// can retry when the reply was lost.
+func (self *MetaDataNodeState) CommitBlob(blobID string, token string, blocks []BlockInfo) error {
+	self.mutex.Lock()
+	open, err := self.checkLease(blobID, token)
+	if err != nil {
+		committed := self.openBlobs[blobID] == nil && self.committedAs(blobID, blocks)
+		self.mutex.Unlock()
+		if committed {
+			return nil
+		}
+		return err
+	}
+	appended := map[BlockID]bool{}
+	for _, b := range open.blocks {
+		appended[b] = true
+	}
+	for _, b := range blocks {
+		if !appended[b.BlockID] {
+			self.mutex.Unlock()
+			return errors.New("Block '" + string(b.BlockID) + "' wasn't appended to blob '" + blobID + "'")
+		}
+		if b.Size < 0 {
+			self.mutex.Unlock()
+			return errors.New("Need a size for every block")
+		}
+		if open.replicas[b.BlockID] < open.wanted[b.BlockID] {
+			self.mutex.Unlock()
+			return fmt.Errorf("Block '%s' is only on %d of %d DataNodes", b.BlockID, open.replicas[b.BlockID], open.wanted[b.BlockID])
+		}
+		delete(appended, b.BlockID)
+	}
+	// So nothing else touches the blob while the edit is proposed
+	delete(self.openBlobs, blobID)
+	self.mutex.Unlock()
+	edit := Edit{Op: "CommitBlob", BlobID: blobID, Path: open.path, Blocks: blocks, Time: time.Now()}
+	_, err = self.propose(edit)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err != nil {
+		// A node that stopped leading has forgotten its open blobs
+		if err != errNotLeader && self.openBlobs[blobID] == nil {
+			self.openBlobs[blobID] = open
+		}
+		return err
+	}
+	// Appended but never written, or written and then replaced
+	for b, _ := range appended {
+		self.deleteBlock(b)
+	}
+	self.blobReplication[blobID] = open.replication
+	return nil
+}
+
+// Whether the blob is committed with exactly these blocks. Must hold mutex.
+func (self *MetaDataNodeState) committedAs(blobID string, blocks []BlockInfo) bool {
+	committed, err := self.store.HasBlob(blobID)
+	if err != nil || !committed {
+		return false
+	}
+	stored, err := self.store.GetBlocks(blobID)
+	if err != nil || len(stored) != len(blocks) {
+		return false
+	}
+	for i, b := range blocks {
+		if stored[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// The client gave up, delete whatever it sent. Does nothing if the upload
+// was resumed in the meantime. Must not hold mutex.
+func (self *MetaDataNodeState) abandonBlob(blobID string) {
+	self.mutex.Lock()
+	blob := self.openBlobs[blobID]
+	if blob == nil || time.Now().Before(blob.expires) {
+		self.mutex.Unlock()
+		return
+	}
+	delete(self.openBlobs, blobID)
+	self.mutex.Unlock()
+	if _, err := self.propose(Edit{Op: "AbandonBlob", BlobID: blobID}); err != nil {
+		// The orphaned blocks are swept up either way
+		log.Println("Metadata store error:", err)
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, b := range blob.blocks {
+		self.deleteBlock(b)
+	}
+	log.Println("Abandoned blob '"+blobID+"' with", len(blob.blocks), "blocks")
+}
+
+// Must not hold mutex
+func (self *MetaDataNodeState) expireLeases() {
+	self.mutex.RLock()
+	var expired []string
+	for blobID, open := range self.openBlobs {
+		if time.Now().After(open.expires) {
+			log.Println("Lease on blob '" + blobID + "' expired")
+			expired = append(expired, blobID)
+		}
+	}
+	self.mutex.RUnlock()
+	for _, blobID := range expired {
+		self.abandonBlob(blobID)
+	}
+}
+
+// Blocks that DataNodes have but that aren't part of any blob, from uploads
+// that didn't finish or from before the MetaDataNode restarted. Blocks get
+// the grace period to show up in a blob. Must hold mutex.
+func (self *MetaDataNodeState) sweepOrphans() {
+	inOpenBlob := map[BlockID]bool{}
+	for _, blob := range self.openBlobs {
+		for _, b := range blob.blocks {
+			inOpenBlob[b] = true
+		}
+	}
+
+	for blockID, seen := range self.unverifiedBlocks {
+		switch {
+		case time.Since(seen) < self.orphanGracePeriod:
+			continue
+
+		case inOpenBlob[blockID]:
+			continue
+
+		case self.deletedBlocks[blockID]:
+			delete(self.unverifiedBlocks, blockID)
+			continue
+		}
+
+		referenced, err := self.store.HasBlock(string(blockID))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !referenced {
+			log.Println("Block '" + blockID + "' is orphaned")
+			self.deleteBlock(blockID)
+		}
+		delete(self.unverifiedBlocks, blockID)
+	}
+}
@@ -2,112 +2,69 @@
 package upload
 
 import (
+	"context"
 	"fmt"
-	"hash/crc32"
-	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"log"
-	"net"
-	"net/rpc"
-	"net/rpc/jsonrpc"
-	"os"
-	"strings"
 
-	. "golang-distributed-filesystem/common"
+	"golang-distributed-filesystem/client"
 )
 
-func Upload(file *os.File, debug bool, leaderAddress string) string {
-	localFileInfo, err := file.Stat()
-	if err != nil {
-		log.Fatal("Stat error: ", err)
-	}
-	localFileSize := localFileInfo.Size()
-
-	conn, err := net.Dial("tcp", leaderAddress)
-	if err != nil {
-		log.Fatal("Dial error:", err)
-	}
-	defer conn.Close()
-	codec := jsonrpc.NewClientCodec(conn)
-	if debug {
-		codec = LoggingClientCodec(
-			conn.RemoteAddr().String(),
-			codec)
-	}
-	client := rpc.NewClientWithCodec(codec)
+// An interrupted upload, as logged when it started
+type Resume struct {
+	BlobID string
+	Token  string
+}
 
-	var blobId string
-	err = client.Call("CreateBlob", nil, &blobId)
-	if err != nil {
-		panic(err)
-		log.Fatalln("CreateBlob error:", err)
+// c says how to upload: checksum, block size, replication factor and blocks
+// at once. path can be empty, to only refer to the blob by its ID. If resume
+// isn't nil, that upload is continued from wherever it got to and path is
+// ignored; file has to be the same data from the start.
+func Upload(c *client.Client, file io.Reader, path string, resume *Resume) string {
+	if c.Progress == nil {
+		c.Progress = func(written int64) {
+			log.Println("Uploaded", written, "bytes")
+		}
 	}
 
-	bytesLeft := localFileSize
-	for bytesLeft > 0 {
-		var nodesMsg ForwardBlock
-		err = client.Call("Append", nil, &nodesMsg)
+	var writer *client.Writer
+	var err error
+	if resume != nil {
+		var offset int64
+		writer, offset, err = c.Resume(context.Background(), resume.BlobID, resume.Token)
 		if err != nil {
-			log.Fatal("Append error:", err)
+			log.Fatalln(err)
 		}
-		blockSize := nodesMsg.Size
-
-		var dataNode net.Conn
-		var forwardTo []string
-		// Find a DataNode
-		for i, addr := range nodesMsg.Nodes {
-			dataNode, err = net.Dial("tcp", addr)
-			if err == nil {
-				forwardTo = append(nodesMsg.Nodes[:i], nodesMsg.Nodes[i+1:]...)
-				break
-			}
-			dataNode = nil
-		}
-		// TODO: Can't compare an interface to nil
-		if dataNode == nil {
-			log.Fatalln("Couldn't connect to any DataNodes in:", strings.Join(nodesMsg.Nodes, " "))
+		log.Println("Resuming at byte", offset)
+		if err := skip(file, offset); err != nil {
+			log.Fatalln(err)
 		}
-		defer dataNode.Close()
-
-		dataNodeCodec := jsonrpc.NewClientCodec(dataNode)
-		if debug {
-			dataNodeCodec = LoggingClientCodec(
-				dataNode.RemoteAddr().String(),
-				dataNodeCodec)
-		}
-		dataNodeClient := rpc.NewClientWithCodec(dataNodeCodec)
-
-		var size int64
-		if blockSize > bytesLeft {
-			size = bytesLeft
-			bytesLeft = 0
-		} else {
-			size = blockSize
-			bytesLeft = bytesLeft - blockSize
-		}
-
-		err = dataNodeClient.Call("Forward",
-			&ForwardBlock{nodesMsg.BlockID, forwardTo, size},
-			nil)
+	} else {
+		writer, err = c.CreateAt(context.Background(), path)
 		if err != nil {
-			log.Fatal("ForwardBlock error: ", err)
+			log.Fatalln(err)
 		}
+		log.Println("Uploading blob", writer.BlobID()+", resume with -resume", writer.BlobID(), "-resumeToken", writer.ResumeToken())
+	}
+	if _, err := io.Copy(writer, file); err != nil {
+		log.Fatalln(err)
+	}
+	if err := writer.Close(); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Blob ID:", writer.BlobID())
 
-		hash := crc32.NewIEEE()
-		io.CopyN(dataNode, io.TeeReader(file, hash), size)
+	return writer.BlobID()
+}
 
-		log.Println("Uploading block with checksum", hex.EncodeToString(hash.Sum([]byte{})))
-		err = dataNodeClient.Call("Confirm", fmt.Sprint(hash.Sum32()), nil)
-		if err != nil {
-			log.Fatal("Confirm error: ", err)
+// Seeks if it can, otherwise reads and throws away, e.g. for stdin
+func skip(file io.Reader, offset int64) error {
+	if seeker, ok := file.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err == nil {
+			return nil
 		}
 	}
-
-	err = client.Call("Commit", nil, nil)
-	if err != nil {
-		log.Fatal("Commit error:", err)
-	}
-	fmt.Println("Blob ID:", blobId)
-
-	return blobId
+	_, err := io.CopyN(ioutil.Discard, file, offset)
+	return err
 }
@@ -30,6 +30,7 @@ type Flags interface {
 	Parse()
 	Var(goflag.Value, string, string)
 	Int(string, int, string) *int
+	Int64(string, int64, string) *int64
 }
 
 type AppConfig struct {
@@ -71,6 +72,11 @@ func (self *flagDummy) Int(name string, value int, usage string) *int {
 	*self.list = append(*self.list, flag)
 	return nil
 }
+func (self *flagDummy) Int64(name string, value int64, usage string) *int64 {
+	flag := flag{name, fmt.Sprintf("%+v", value), usage}
+	*self.list = append(*self.list, flag)
+	return nil
+}
 func (self *flagDummy) Var(value goflag.Value, name string, usage string) {
 	flag := flag{name, value.String(), usage}
 	*self.list = append(*self.list, flag)
@@ -162,6 +168,11 @@ func (self *AppConfig) Run() {
 	}
 	command := commandArgs[0]
 	os.Args = commandArgs[1:]
+	// Subcommands are registered as "command subcommand"
+	if len(os.Args) > 0 && self.hasCommand(command+" "+os.Args[0]) {
+		command += " " + os.Args[0]
+		os.Args = os.Args[1:]
+	}
 	for _, c := range self.commands {
 		if c.name == command {
 			set := newFlagSet(self)
@@ -173,6 +184,15 @@ func (self *AppConfig) Run() {
 	self.Usage()
 }
 
+func (self *AppConfig) hasCommand(name string) bool {
+	for _, c := range self.commands {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *AppConfig) Usage() {
 	fmt.Println("Usage:", self.whoami, "[global flags]", "command", "[flags]")
 	fmt.Println("Global:")
@@ -36,6 +36,24 @@ func (self *listenerFlag) Get() net.Listener {
 	return listener
 }
 
+type packetListenerFlag struct {
+	listenerFlag
+}
+
+// A UDP port
+func PacketListenerFlag(flags Flags, name string, value int, usage string) *packetListenerFlag {
+	self := &packetListenerFlag{listenerFlag{port: value}}
+	flags.Var(self, name, usage)
+	return self
+}
+func (self *packetListenerFlag) Get() net.PacketConn {
+	conn, err := net.ListenPacket("udp", ":"+self.String())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return conn
+}
+
 type fileFlag struct {
 	name     string
 	filename string
@@ -61,9 +79,37 @@ func (self *fileFlag) Get() *os.File {
 		fmt.Println("run with command 'help' for usage information")
 		os.Exit(2)
 	}
+	if self.filename == "-" {
+		return os.Stdin
+	}
 	file, err := os.Open(self.filename)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return file
 }
+
+type outputFileFlag struct {
+	fileFlag
+}
+
+func OutputFileFlag(flags Flags, name string, usage string) *outputFileFlag {
+	self := &outputFileFlag{fileFlag{name, "", false}}
+	flags.Var(self, name, usage)
+	return self
+}
+func (self *outputFileFlag) Get() *os.File {
+	if !self.set {
+		fmt.Println("flag must be provided:", "-"+self.name)
+		fmt.Println("run with command 'help' for usage information")
+		os.Exit(2)
+	}
+	if self.filename == "-" {
+		return os.Stdout
+	}
+	file, err := os.Create(self.filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return file
+}